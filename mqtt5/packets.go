@@ -0,0 +1,216 @@
+package mqtt5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Control packet types
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+	packetAuth        = 15
+)
+
+var packetNames = map[byte]string{
+	packetConnect:     "CONNECT",
+	packetConnack:     "CONNACK",
+	packetPublish:     "PUBLISH",
+	packetPuback:      "PUBACK",
+	packetPubrec:      "PUBREC",
+	packetPubrel:      "PUBREL",
+	packetPubcomp:     "PUBCOMP",
+	packetSubscribe:   "SUBSCRIBE",
+	packetSuback:      "SUBACK",
+	packetUnsubscribe: "UNSUBSCRIBE",
+	packetUnsuback:    "UNSUBACK",
+	packetPingreq:     "PINGREQ",
+	packetPingresp:    "PINGRESP",
+	packetDisconnect:  "DISCONNECT",
+	packetAuth:        "AUTH",
+}
+
+var errMalformed = errors.New("malformed packet")
+
+// A control packet, the fixed header split into type and flags
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(r *bufio.Reader) (*packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := readVarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	return &packet{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+// Encode the packet with its fixed header
+func (p *packet) bytes() []byte {
+	w := &writer{}
+	w.putByte(p.kind<<4 | p.flags)
+	w.putVarint(len(p.body))
+	w.Write(p.body)
+	return w.Bytes()
+}
+
+func readVarint(r io.ByteReader) (int, error) {
+	n, shift := 0, uint(0)
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return n, nil
+		}
+		shift += 7
+	}
+	return 0, errMalformed
+}
+
+// Builds packet bodies in the MQTT data representations
+type writer struct {
+	bytes.Buffer
+}
+
+func (w *writer) putByte(b byte) {
+	w.WriteByte(b)
+}
+
+func (w *writer) putUint16(n uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], n)
+	w.Write(b[:])
+}
+
+func (w *writer) putUint32(n uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	w.Write(b[:])
+}
+
+func (w *writer) putVarint(n int) {
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			b |= 0x80
+		}
+		w.WriteByte(b)
+		if n == 0 {
+			return
+		}
+	}
+}
+
+func (w *writer) putString(s string) {
+	w.putUint16(uint16(len(s)))
+	w.WriteString(s)
+}
+
+func (w *writer) putBinary(b []byte) {
+	w.putUint16(uint16(len(b)))
+	w.Write(b)
+}
+
+// Reads the MQTT data representations from a packet body. The first read
+// past the end marks the reader malformed, later reads return zero values.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) take(n int) []byte {
+	if r.err != nil || n > len(r.b) {
+		r.err = errMalformed
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) readByte() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) readUint16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) readUint32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) readVarint() int {
+	if r.err != nil {
+		return 0
+	}
+	buf := bytes.NewReader(r.b)
+	n, err := readVarint(buf)
+	if err != nil {
+		r.err = errMalformed
+		return 0
+	}
+	r.b = r.b[len(r.b)-buf.Len():]
+	return n
+}
+
+func (r *reader) readString() string {
+	return string(r.readBinary())
+}
+
+func (r *reader) readBinary() []byte {
+	n := int(r.readUint16())
+	return r.take(n)
+}
+
+// The rest of the body, e.g. a PUBLISH payload
+func (r *reader) rest() []byte {
+	b := r.b
+	r.b = nil
+	return b
+}
+
+func (r *reader) empty() bool {
+	return len(r.b) == 0
+}
@@ -0,0 +1,251 @@
+package mqtt5
+
+import (
+	"fmt"
+)
+
+// Property identifiers
+const (
+	propPayloadFormat        = 0x01
+	propMessageExpiry        = 0x02
+	propContentType          = 0x03
+	propResponseTopic        = 0x08
+	propCorrelationData      = 0x09
+	propSubscriptionID       = 0x0b
+	propSessionExpiry        = 0x11
+	propAssignedClientID     = 0x12
+	propServerKeepAlive      = 0x13
+	propAuthMethod           = 0x15
+	propAuthData             = 0x16
+	propRequestProblemInfo   = 0x17
+	propWillDelay            = 0x18
+	propRequestResponseInfo  = 0x19
+	propResponseInfo         = 0x1a
+	propServerReference      = 0x1c
+	propReasonString         = 0x1f
+	propReceiveMaximum       = 0x21
+	propTopicAliasMaximum    = 0x22
+	propTopicAlias           = 0x23
+	propMaximumQoS           = 0x24
+	propRetainAvailable      = 0x25
+	propUserProperty         = 0x26
+	propMaximumPacketSize    = 0x27
+	propWildcardSubAvailable = 0x28
+	propSubIDAvailable       = 0x29
+	propSharedSubAvailable   = 0x2a
+)
+
+// Payload format indicator values
+const (
+	FormatBytes byte = 0 // unspecified bytes
+	FormatUTF8  byte = 1 // UTF-8 encoded character data
+)
+
+// UserProperty is an application defined name/value pair. Names can repeat.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties are the MQTT 5 packet properties plumber uses. Optional
+// numeric properties are pointers, nil when absent.
+type Properties struct {
+	// PUBLISH
+	PayloadFormat   *byte
+	MessageExpiry   *uint32 // seconds
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+	SubscriptionIDs []int
+	TopicAlias      uint16
+
+	// CONNECT and CONNACK
+	SessionExpiry        *uint32 // seconds
+	ReceiveMaximum       uint16
+	MaximumPacketSize    uint32
+	TopicAliasMaximum    uint16
+	AssignedClientID     string
+	ServerKeepAlive      *uint16 // seconds
+	MaximumQoS           *byte
+	RetainAvailable      *byte
+	WildcardSubAvailable *byte
+	SubIDAvailable       *byte
+	SharedSubAvailable   *byte
+	ResponseInfo         string
+	ServerReference      string
+
+	// Any ack or DISCONNECT
+	ReasonString string
+
+	User []UserProperty
+}
+
+// Get returns the values of a user property, in the order they were sent
+func (p *Properties) Get(key string) []string {
+	if p == nil {
+		return nil
+	}
+	var values []string
+	for _, prop := range p.User {
+		if prop.Key == key {
+			values = append(values, prop.Value)
+		}
+	}
+	return values
+}
+
+// Whether an optional flag property is absent or set, servers only send the
+// availability properties when the feature is missing
+func available(flag *byte) bool {
+	return flag == nil || *flag == 1
+}
+
+func (r *reader) readProperties() *Properties {
+	length := r.readVarint()
+	body := &reader{b: r.take(length)}
+	if r.err != nil {
+		return nil
+	}
+
+	p := &Properties{}
+	for !body.empty() && body.err == nil {
+		byteValue := func() *byte {
+			b := body.readByte()
+			return &b
+		}
+
+		switch id := body.readVarint(); id {
+		case propPayloadFormat:
+			p.PayloadFormat = byteValue()
+		case propMessageExpiry:
+			n := body.readUint32()
+			p.MessageExpiry = &n
+		case propContentType:
+			p.ContentType = body.readString()
+		case propResponseTopic:
+			p.ResponseTopic = body.readString()
+		case propCorrelationData:
+			p.CorrelationData = body.readBinary()
+		case propSubscriptionID:
+			p.SubscriptionIDs = append(p.SubscriptionIDs, body.readVarint())
+		case propSessionExpiry:
+			n := body.readUint32()
+			p.SessionExpiry = &n
+		case propAssignedClientID:
+			p.AssignedClientID = body.readString()
+		case propServerKeepAlive:
+			n := body.readUint16()
+			p.ServerKeepAlive = &n
+		case propResponseInfo:
+			p.ResponseInfo = body.readString()
+		case propServerReference:
+			p.ServerReference = body.readString()
+		case propReasonString:
+			p.ReasonString = body.readString()
+		case propReceiveMaximum:
+			p.ReceiveMaximum = body.readUint16()
+		case propTopicAliasMaximum:
+			p.TopicAliasMaximum = body.readUint16()
+		case propTopicAlias:
+			p.TopicAlias = body.readUint16()
+		case propMaximumQoS:
+			p.MaximumQoS = byteValue()
+		case propRetainAvailable:
+			p.RetainAvailable = byteValue()
+		case propUserProperty:
+			p.User = append(p.User, UserProperty{body.readString(), body.readString()})
+		case propMaximumPacketSize:
+			p.MaximumPacketSize = body.readUint32()
+		case propWildcardSubAvailable:
+			p.WildcardSubAvailable = byteValue()
+		case propSubIDAvailable:
+			p.SubIDAvailable = byteValue()
+		case propSharedSubAvailable:
+			p.SharedSubAvailable = byteValue()
+
+		// Sent by servers, but nothing plumber uses
+		case propAuthMethod:
+			body.readString()
+		case propAuthData:
+			body.readBinary()
+		case propRequestProblemInfo, propRequestResponseInfo:
+			body.readByte()
+		case propWillDelay:
+			body.readUint32()
+
+		default:
+			r.err = fmt.Errorf("unknown property 0x%02x", id)
+			return nil
+		}
+	}
+
+	if body.err != nil {
+		r.err = body.err
+		return nil
+	}
+	return p
+}
+
+// Write the properties, prefixed with their length. Nil writes an empty
+// property list.
+func (w *writer) putProperties(p *Properties) {
+	if p == nil {
+		w.putVarint(0)
+		return
+	}
+
+	props := &writer{}
+	putByte := func(id int, b *byte) {
+		if b != nil {
+			props.putVarint(id)
+			props.putByte(*b)
+		}
+	}
+	putString := func(id int, s string) {
+		if len(s) > 0 {
+			props.putVarint(id)
+			props.putString(s)
+		}
+	}
+
+	putByte(propPayloadFormat, p.PayloadFormat)
+	if p.MessageExpiry != nil {
+		props.putVarint(propMessageExpiry)
+		props.putUint32(*p.MessageExpiry)
+	}
+	putString(propContentType, p.ContentType)
+	putString(propResponseTopic, p.ResponseTopic)
+	if p.CorrelationData != nil {
+		props.putVarint(propCorrelationData)
+		props.putBinary(p.CorrelationData)
+	}
+	for _, id := range p.SubscriptionIDs {
+		props.putVarint(propSubscriptionID)
+		props.putVarint(id)
+	}
+	if p.SessionExpiry != nil {
+		props.putVarint(propSessionExpiry)
+		props.putUint32(*p.SessionExpiry)
+	}
+	if p.ReceiveMaximum > 0 {
+		props.putVarint(propReceiveMaximum)
+		props.putUint16(p.ReceiveMaximum)
+	}
+	if p.MaximumPacketSize > 0 {
+		props.putVarint(propMaximumPacketSize)
+		props.putUint32(p.MaximumPacketSize)
+	}
+	if p.TopicAliasMaximum > 0 {
+		props.putVarint(propTopicAliasMaximum)
+		props.putUint16(p.TopicAliasMaximum)
+	}
+	putString(propReasonString, p.ReasonString)
+	for _, prop := range p.User {
+		props.putVarint(propUserProperty)
+		props.putString(prop.Key)
+		props.putString(prop.Value)
+	}
+
+	w.putVarint(props.Len())
+	w.Write(props.Bytes())
+}
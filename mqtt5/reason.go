@@ -0,0 +1,140 @@
+package mqtt5
+
+import (
+	"fmt"
+)
+
+// ReasonCode is the result of an operation, as reported by the server in
+// acks and DISCONNECT. Codes from 0x80 up are failures.
+type ReasonCode byte
+
+const (
+	Success                    ReasonCode = 0x00
+	GrantedQoS1                ReasonCode = 0x01
+	GrantedQoS2                ReasonCode = 0x02
+	DisconnectWithWill         ReasonCode = 0x04
+	NoMatchingSubscribers      ReasonCode = 0x10
+	NoSubscriptionExisted      ReasonCode = 0x11
+	ContinueAuthentication     ReasonCode = 0x18
+	ReAuthenticate             ReasonCode = 0x19
+	UnspecifiedError           ReasonCode = 0x80
+	MalformedPacket            ReasonCode = 0x81
+	ProtocolError              ReasonCode = 0x82
+	ImplementationError        ReasonCode = 0x83
+	UnsupportedProtocolVersion ReasonCode = 0x84
+	ClientIDNotValid           ReasonCode = 0x85
+	BadUsernameOrPassword      ReasonCode = 0x86
+	NotAuthorized              ReasonCode = 0x87
+	ServerUnavailable          ReasonCode = 0x88
+	ServerBusy                 ReasonCode = 0x89
+	Banned                     ReasonCode = 0x8a
+	ServerShuttingDown         ReasonCode = 0x8b
+	BadAuthenticationMethod    ReasonCode = 0x8c
+	KeepAliveTimeout           ReasonCode = 0x8d
+	SessionTakenOver           ReasonCode = 0x8e
+	TopicFilterInvalid         ReasonCode = 0x8f
+	TopicNameInvalid           ReasonCode = 0x90
+	PacketIDInUse              ReasonCode = 0x91
+	PacketIDNotFound           ReasonCode = 0x92
+	ReceiveMaximumExceeded     ReasonCode = 0x93
+	TopicAliasInvalid          ReasonCode = 0x94
+	PacketTooLarge             ReasonCode = 0x95
+	MessageRateTooHigh         ReasonCode = 0x96
+	QuotaExceeded              ReasonCode = 0x97
+	AdministrativeAction       ReasonCode = 0x98
+	PayloadFormatInvalid       ReasonCode = 0x99
+	RetainNotSupported         ReasonCode = 0x9a
+	QoSNotSupported            ReasonCode = 0x9b
+	UseAnotherServer           ReasonCode = 0x9c
+	ServerMoved                ReasonCode = 0x9d
+	SharedSubNotSupported      ReasonCode = 0x9e
+	ConnectionRateExceeded     ReasonCode = 0x9f
+	MaximumConnectTime         ReasonCode = 0xa0
+	SubIDsNotSupported         ReasonCode = 0xa1
+	WildcardSubsNotSupported   ReasonCode = 0xa2
+)
+
+var reasonNames = map[ReasonCode]string{
+	Success:                    "success",
+	GrantedQoS1:                "granted qos 1",
+	GrantedQoS2:                "granted qos 2",
+	DisconnectWithWill:         "disconnect with will message",
+	NoMatchingSubscribers:      "no matching subscribers",
+	NoSubscriptionExisted:      "no subscription existed",
+	ContinueAuthentication:     "continue authentication",
+	ReAuthenticate:             "re-authenticate",
+	UnspecifiedError:           "unspecified error",
+	MalformedPacket:            "malformed packet",
+	ProtocolError:              "protocol error",
+	ImplementationError:        "implementation specific error",
+	UnsupportedProtocolVersion: "unsupported protocol version",
+	ClientIDNotValid:           "client identifier not valid",
+	BadUsernameOrPassword:      "bad user name or password",
+	NotAuthorized:              "not authorized",
+	ServerUnavailable:          "server unavailable",
+	ServerBusy:                 "server busy",
+	Banned:                     "banned",
+	ServerShuttingDown:         "server shutting down",
+	BadAuthenticationMethod:    "bad authentication method",
+	KeepAliveTimeout:           "keep alive timeout",
+	SessionTakenOver:           "session taken over",
+	TopicFilterInvalid:         "topic filter invalid",
+	TopicNameInvalid:           "topic name invalid",
+	PacketIDInUse:              "packet identifier in use",
+	PacketIDNotFound:           "packet identifier not found",
+	ReceiveMaximumExceeded:     "receive maximum exceeded",
+	TopicAliasInvalid:          "topic alias invalid",
+	PacketTooLarge:             "packet too large",
+	MessageRateTooHigh:         "message rate too high",
+	QuotaExceeded:              "quota exceeded",
+	AdministrativeAction:       "administrative action",
+	PayloadFormatInvalid:       "payload format invalid",
+	RetainNotSupported:         "retain not supported",
+	QoSNotSupported:            "qos not supported",
+	UseAnotherServer:           "use another server",
+	ServerMoved:                "server moved",
+	SharedSubNotSupported:      "shared subscriptions not supported",
+	ConnectionRateExceeded:     "connection rate exceeded",
+	MaximumConnectTime:         "maximum connect time",
+	SubIDsNotSupported:         "subscription identifiers not supported",
+	WildcardSubsNotSupported:   "wildcard subscriptions not supported",
+}
+
+func (c ReasonCode) String() string {
+	if name, ok := reasonNames[c]; ok {
+		return name
+	}
+	return "unknown reason"
+}
+
+// Failed reports whether the code is an error
+func (c ReasonCode) Failed() bool {
+	return c >= 0x80
+}
+
+// Error is a failure the server reported with a reason code
+type Error struct {
+	Op     string // what failed, e.g. "connect" or "subscribe to sensors/#"
+	Code   ReasonCode
+	Reason string // the server's reason string, if it sent one
+}
+
+func (e *Error) Error() string {
+	s := fmt.Sprintf("%s: %s (0x%02x)", e.Op, e.Code, byte(e.Code))
+	if len(e.Reason) > 0 {
+		s += ": " + e.Reason
+	}
+	return s
+}
+
+// An error for the reason code, or nil if it's not a failure
+func reasonError(op string, code ReasonCode, props *Properties) error {
+	if !code.Failed() {
+		return nil
+	}
+	err := &Error{Op: op, Code: code}
+	if props != nil {
+		err.Reason = props.ReasonString
+	}
+	return err
+}
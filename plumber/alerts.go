@@ -0,0 +1,298 @@
+package plumber
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alert states
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// How long to wait for the alert webhook to respond
+const alertWebhookTimeout = 10 * time.Second
+
+// AlertCondition is what an alert rule checks for: a numeric threshold with
+// hysteresis, a payload field (in)equality, or the absence of messages
+type AlertCondition struct {
+	Name      string // as configured
+	Field     string
+	Op        string // >, <, ==, !=
+	Value     string // for == and !=
+	Threshold float64
+	Clear     float64       // threshold back past which the alert resolves
+	Absent    time.Duration // for absence checks
+}
+
+var reAlertCompare = regexp.MustCompile(`^([^<>=!~\s]+)\s*(>|<|==|!=)\s*([^~]*?)\s*(?:~\s*(.+))?$`)
+
+// Parse an alert rule value, one of `field>n[~clear]`, `field<n[~clear]`,
+// `field==value`, `field!=value` or `absent:duration`, e.g. "temp>30~28"
+func parseAlertCondition(value string) (interface{}, error) {
+	cond := &AlertCondition{Name: value}
+
+	if strings.HasPrefix(value, "absent:") {
+		d, err := time.ParseDuration(strings.TrimPrefix(value, "absent:"))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid absence duration in %q", value)
+		}
+		cond.Absent = d
+		return cond, nil
+	}
+
+	m := reAlertCompare.FindStringSubmatch(value)
+	if m == nil {
+		return nil, fmt.Errorf("invalid alert condition %q", value)
+	}
+	cond.Field, cond.Op, cond.Value = m[1], m[2], m[3]
+
+	if cond.Op == ">" || cond.Op == "<" {
+		threshold, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold in %q", value)
+		}
+		cond.Threshold, cond.Clear = threshold, threshold
+		if len(m[4]) > 0 {
+			if cond.Clear, err = strconv.ParseFloat(m[4], 64); err != nil {
+				return nil, fmt.Errorf("invalid clear threshold in %q", value)
+			}
+		}
+	} else if len(m[4]) > 0 {
+		return nil, fmt.Errorf("hysteresis only applies to > and < in %q", value)
+	}
+
+	return cond, nil
+}
+
+// Check a field value, given whether the alert is currently firing. Returns
+// whether it should be firing now, ok is false when the value doesn't apply.
+func (c *AlertCondition) check(value interface{}, firing bool) (fire bool, ok bool) {
+	switch c.Op {
+	case "==", "!=":
+		if value == nil {
+			return false, false
+		}
+		equal := fmt.Sprint(value) == c.Value
+		return equal == (c.Op == "=="), true
+	}
+
+	n, ok := value.(float64)
+	if !ok {
+		return false, false
+	}
+
+	// Past the threshold fires, but only back past the clear threshold resolves
+	if c.Op == ">" {
+		if firing {
+			return n > c.Clear, true
+		}
+		return n > c.Threshold, true
+	}
+	if firing {
+		return n < c.Clear, true
+	}
+	return n < c.Threshold, true
+}
+
+// AlertEvent is the notification sent when an alert fires or resolves
+type AlertEvent struct {
+	Alert  string      `json:"alert"`
+	State  string      `json:"state"`
+	Broker string      `json:"broker,omitempty"` // for named brokers
+	Topic  string      `json:"topic"`
+	Value  interface{} `json:"value,omitempty"`
+	Time   time.Time   `json:"time"`
+}
+
+// Alerts evaluates alert rules against incoming messages, and notifies when
+// they fire or resolve
+type Alerts struct {
+	sync.Mutex
+	rules   Rules
+	topic   string // MQTT topic to publish events to, if any
+	webhook string // URL to POST events to, if any
+	publish func(topic string, payload []byte, done func(err error))
+	firing  map[string]bool
+	seen    map[*Rule]time.Time // last message, for absence rules
+
+	stop, done chan struct{}
+}
+
+func NewAlerts(rules Rules, topic string, webhook string, publish func(topic string, payload []byte, done func(err error))) *Alerts {
+	a := &Alerts{
+		rules:   rules,
+		topic:   topic,
+		webhook: webhook,
+		publish: publish,
+		firing:  make(map[string]bool),
+		seen:    make(map[*Rule]time.Time),
+	}
+
+	// Absence is measured from startup until the first message
+	now := time.Now()
+	for _, rule := range rules {
+		a.seen[rule] = now
+	}
+
+	return a
+}
+
+// Check a message against every matching alert rule. Thresholds are tracked
+// per broker and topic.
+func (a *Alerts) Check(messageTopic string, data map[string]interface{}, received time.Time) {
+	var events []*AlertEvent
+	broker, _ := data["broker"].(string)
+
+	a.Lock()
+	for _, rule := range a.rules {
+		if !rule.Match(messageTopic) {
+			continue
+		}
+
+		cond := rule.Value.(*AlertCondition)
+		if cond.Absent > 0 {
+			a.seen[rule] = received
+			key := rule.Filter + " " + cond.Name
+			if a.firing[key] {
+				delete(a.firing, key)
+				events = append(events, a.event(rule, alertResolved, broker, messageTopic, nil, received))
+			}
+			continue
+		}
+
+		key := rule.Filter + " " + cond.Name + " " + broker + " " + messageTopic
+		value := data[cond.Field]
+		fire, ok := cond.check(value, a.firing[key])
+		if !ok || fire == a.firing[key] {
+			continue
+		}
+
+		state := alertResolved
+		if fire {
+			state = alertFiring
+			a.firing[key] = true
+		} else {
+			delete(a.firing, key)
+		}
+		events = append(events, a.event(rule, state, broker, messageTopic, value, received))
+	}
+	a.Unlock()
+
+	for _, event := range events {
+		a.notify(event)
+	}
+}
+
+// Fire absence alerts for filters that have been quiet for too long
+func (a *Alerts) CheckAbsence(now time.Time) {
+	var events []*AlertEvent
+
+	a.Lock()
+	for _, rule := range a.rules {
+		cond := rule.Value.(*AlertCondition)
+		key := rule.Filter + " " + cond.Name
+		if cond.Absent == 0 || a.firing[key] || now.Sub(a.seen[rule]) < cond.Absent {
+			continue
+		}
+
+		a.firing[key] = true
+		events = append(events, a.event(rule, alertFiring, "", rule.Filter, nil, now))
+	}
+	a.Unlock()
+
+	for _, event := range events {
+		a.notify(event)
+	}
+}
+
+// Check for absence every interval, in the background until Stop
+func (a *Alerts) Run(interval time.Duration) {
+	a.stop, a.done = make(chan struct{}), make(chan struct{})
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				a.CheckAbsence(now)
+			case <-stop:
+				return
+			}
+		}
+	}(a.stop, a.done)
+}
+
+// Stop checking for absence, waiting for a check in progress
+func (a *Alerts) Stop() {
+	if a.stop == nil {
+		return
+	}
+	close(a.stop)
+	<-a.done
+	a.stop, a.done = nil, nil
+}
+
+func (a *Alerts) event(rule *Rule, state string, broker string, topic string, value interface{}, t time.Time) *AlertEvent {
+	return &AlertEvent{
+		Alert:  rule.Filter + " " + rule.Value.(*AlertCondition).Name,
+		State:  state,
+		Broker: broker,
+		Topic:  topic,
+		Value:  value,
+		Time:   t,
+	}
+}
+
+func (a *Alerts) notify(event *AlertEvent) {
+	c := OK
+	if event.State == alertFiring {
+		c = ERR
+	}
+	out := fmt.Sprintf("%s %s on %s", event.Alert, event.State, event.Topic)
+	if len(event.Broker) > 0 {
+		out += " at " + event.Broker
+	}
+	if event.Value != nil {
+		out += fmt.Sprintf(" (%v)", event.Value)
+	}
+	status("ALERT", c, out+"\n")
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		status("ALERT", ERR, fmt.Sprintln("Failed to encode alert", err))
+		return
+	}
+
+	if len(a.topic) > 0 {
+		a.publish(a.topic, payload, func(err error) {
+			if err != nil {
+				status("ALERT", ERR, fmt.Sprintln("Failed to publish alert to", a.topic, err))
+			}
+		})
+	}
+
+	if len(a.webhook) > 0 {
+		go func() {
+			client := &http.Client{Timeout: alertWebhookTimeout}
+			resp, err := client.Post(a.webhook, "application/json", bytes.NewReader(payload))
+			if err != nil {
+				status("ALERT", ERR, fmt.Sprintln("Failed to post alert to", a.webhook, err))
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				status("ALERT", ERR, fmt.Sprintln("Failed to post alert to", a.webhook, resp.Status))
+			}
+		}()
+	}
+}
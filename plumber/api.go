@@ -0,0 +1,169 @@
+package plumber
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//
+// HTTP API
+//
+
+// Serve the HTTP API on addr, in the background until Stop
+func (p *Plumber) serveAPI(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/last", p.onLastRequested)
+	mux.HandleFunc("/tracks", p.onTracksRequested)
+	mux.HandleFunc("/query", p.onQueryRequested)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	p.api = &http.Server{Handler: mux}
+
+	go func(api *http.Server) {
+		if err := api.Serve(listener); err != nil && err != http.ErrServerClosed {
+			status("ERR", ERR, fmt.Sprintln("HTTP API stopped:", err))
+		}
+	}(p.api)
+
+	status("OK", OK, fmt.Sprintf("Serving HTTP API on %s\n", addr))
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// GET /last?topic=filter[&broker=name]
+//
+// Latest value on every cached topic matching the topic filter (default #),
+// optionally only from one of the named brokers
+func (p *Plumber) onLastRequested(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	if p.lastValues == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("last value cache is disabled"))
+		return
+	}
+
+	filter := r.URL.Query().Get("topic")
+	if len(filter) == 0 {
+		filter = "#"
+	}
+
+	values := p.lastValues.Match(filter)
+	if broker := r.URL.Query().Get("broker"); len(broker) > 0 {
+		matched := []*LastValue{}
+		for _, value := range values {
+			if value.Broker == broker {
+				matched = append(matched, value)
+			}
+		}
+		values = matched
+	}
+
+	writeJSON(w, http.StatusOK, values)
+}
+
+// GET /tracks?series=name[&device=id][&from=t][&to=t][&format=geojson|gpx][&tolerance=meters][&gap=duration][&jump=meters]
+//
+// Device tracks rebuilt from the locations persisted to a series. Times are
+// RFC3339 or a duration ago, default the last 24h. The range and points are
+// capped like queries.
+func (p *Plumber) onTracksRequested(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	query := r.URL.Query()
+	series := query.Get("series")
+	if len(series) == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing series"))
+		return
+	}
+
+	format := query.Get("format")
+	if len(format) == 0 {
+		format = "geojson"
+	}
+	contentType, ok := TrackContentType(format)
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q", format))
+		return
+	}
+
+	from, to, err := p.TrackRange(query.Get("from"), query.Get("to"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	options := TrackOptions{Device: query.Get("device"), Gap: DefaultTrackGap}
+	if s := query.Get("gap"); len(s) > 0 {
+		if options.Gap, err = time.ParseDuration(s); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid gap %q", s))
+			return
+		}
+	}
+	for name, value := range map[string]*float64{"tolerance": &options.Tolerance, "jump": &options.Jump} {
+		if s := query.Get(name); len(s) > 0 {
+			if *value, err = strconv.ParseFloat(s, 64); err != nil || *value < 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s %q", name, s))
+				return
+			}
+		}
+	}
+
+	tracks, err := p.Tracks(series, from, to, options)
+	if _, ok := err.(*TrackLimitError); ok || err == errQueriesDisabled {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	WriteTracks(w, tracks, format)
+}
+
+// GET /query?q=statement
+//
+// Run a SELECT or SHOW MEASUREMENTS statement on plumber's series, rewritten
+// to stay within the max time range and row limit
+func (p *Plumber) onQueryRequested(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	statement, rendered, err := p.checkQuery(r.URL.Query().Get("q"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	result, err := p.runQuery(statement, rendered)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
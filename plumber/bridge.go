@@ -0,0 +1,229 @@
+package plumber
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+)
+
+// How long a forwarded message is remembered, to recognize it if the broker
+// echoes it back through one of the bridge subscriptions
+const bridgeEchoWindow = 10 * time.Second
+
+// BridgeRoute rewrites the topic of forwarded messages, and optionally
+// overrides their QoS and retained flag
+type BridgeRoute struct {
+	Strip  string
+	Add    string
+	Qos    *byte
+	Retain *bool
+}
+
+// Parser of `option;option` bridge rule values, where options are
+// `strip[:prefix]` (defaults to prefix), `add:prefix`, `qos:n` and
+// `retain:bool`, e.g. "strip;add:sites/home;qos:1"
+func bridgeRouteParser(prefix string) func(value string) (interface{}, error) {
+	return func(value string) (interface{}, error) {
+		return parseBridgeRoute(value, prefix)
+	}
+}
+
+func parseBridgeRoute(value string, prefix string) (interface{}, error) {
+	route := &BridgeRoute{}
+	for _, option := range strings.Split(value, ";") {
+		option = strings.TrimSpace(option)
+		if len(option) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(option, ":", 2)
+		var arg string
+		if len(parts) > 1 {
+			arg = strings.Trim(parts[1], "/")
+		}
+
+		switch parts[0] {
+		case "strip":
+			route.Strip = arg
+			if len(parts) == 1 {
+				route.Strip = strings.Trim(prefix, "/")
+			}
+		case "add":
+			route.Add = arg
+		case "qos":
+			qos, err := strconv.ParseUint(arg, 10, 8)
+			if err != nil || qos > 2 {
+				return nil, fmt.Errorf("invalid qos %q", arg)
+			}
+			b := byte(qos)
+			route.Qos = &b
+		case "retain":
+			retain, err := strconv.ParseBool(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid retain %q", arg)
+			}
+			route.Retain = &retain
+		default:
+			return nil, fmt.Errorf("unknown bridge option %q", parts[0])
+		}
+	}
+	return route, nil
+}
+
+// Topic rewrites a topic for the other side of the bridge
+func (r *BridgeRoute) Topic(topic string) string {
+	if len(r.Strip) > 0 {
+		if topic == r.Strip {
+			topic = ""
+		} else if strings.HasPrefix(topic, r.Strip+"/") {
+			topic = strings.TrimPrefix(topic, r.Strip+"/")
+		}
+	}
+	if len(r.Add) > 0 {
+		if len(topic) == 0 {
+			return r.Add
+		}
+		topic = r.Add + "/" + topic
+	}
+	return topic
+}
+
+// Remembers recently forwarded messages per destination
+type bridgeEchoes struct {
+	sync.Mutex
+	sent map[string]time.Time
+}
+
+func bridgeEchoKey(side string, topic string, payload []byte) string {
+	return fmt.Sprintf("%s %s %x", side, topic, sha1.Sum(payload))
+}
+
+func (e *bridgeEchoes) remember(key string) {
+	e.Lock()
+	defer e.Unlock()
+
+	now := time.Now()
+	for k, t := range e.sent {
+		if now.Sub(t) > bridgeEchoWindow {
+			delete(e.sent, k)
+		}
+	}
+	e.sent[key] = now
+}
+
+// Check whether the message is one we forwarded, and forget it if so
+func (e *bridgeEchoes) seen(key string) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	t, ok := e.sent[key]
+	if ok {
+		delete(e.sent, key)
+	}
+	return ok && time.Since(t) <= bridgeEchoWindow
+}
+
+// Bridge forwards messages between the local broker and a remote one. It uses
+// its own client on each side, so its subscriptions don't interfere with the
+// watch list.
+type Bridge struct {
+	local, remote *MQTT.Client
+	out, in       Rules // local -> remote, remote -> local
+	echoes        *bridgeEchoes
+	verbose       bool
+}
+
+func NewBridge(out Rules, in Rules, verbose bool) *Bridge {
+	return &Bridge{out: out, in: in, echoes: &bridgeEchoes{sent: make(map[string]time.Time)}, verbose: verbose}
+}
+
+func bridgeClient(broker string, clientID string) (*MQTT.Client, error) {
+	opts := MQTT.NewClientOptions()
+	opts.SetClientID(clientID)
+
+	opts.AddBroker(pahoCredentials(opts, broker))
+
+	client := MQTT.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return client, nil
+}
+
+// Connect both sides and subscribe to the forwarded topic filters
+func (b *Bridge) Connect(localBroker string, remoteBroker string, clientID string, qos byte) error {
+	var err error
+	if b.local, err = bridgeClient(localBroker, clientID+"-bl"); err != nil {
+		return err
+	}
+	if b.remote, err = bridgeClient(remoteBroker, clientID+"-br"); err != nil {
+		return err
+	}
+
+	status("OK", OK, fmt.Sprintf("Bridging to %s\n", remoteBroker))
+
+	forward := func(rules Rules, from, to *MQTT.Client, fromSide, toSide string) error {
+		handler := func(client *MQTT.Client, message MQTT.Message) {
+			b.forward(rules, message, to, fromSide, toSide)
+		}
+		for _, rule := range rules {
+			if token := from.Subscribe(rule.Filter, qos, handler); token.Wait() && token.Error() != nil {
+				return fmt.Errorf("failed to subscribe to %s on %s broker: %s", rule.Filter, fromSide, token.Error())
+			}
+			status("OK", OK, fmt.Sprintf("Forwarding %s %s -> %s\n", rule.Filter, fromSide, toSide))
+		}
+		return nil
+	}
+
+	if err := forward(b.out, b.local, b.remote, "local", "remote"); err != nil {
+		return err
+	}
+	return forward(b.in, b.remote, b.local, "remote", "local")
+}
+
+// Disconnect both sides
+func (b *Bridge) Disconnect() {
+	for _, client := range []*MQTT.Client{b.local, b.remote} {
+		if client != nil {
+			client.Disconnect(250)
+		}
+	}
+}
+
+func (b *Bridge) forward(rules Rules, message MQTT.Message, to *MQTT.Client, fromSide string, toSide string) {
+	// Don't send back what we just forwarded to this side
+	if b.echoes.seen(bridgeEchoKey(fromSide, message.Topic(), message.Payload())) {
+		return
+	}
+
+	rule := rules.Match(message.Topic())
+	if rule == nil {
+		return
+	}
+
+	route := rule.Value.(*BridgeRoute)
+	topic := route.Topic(message.Topic())
+	qos := message.Qos()
+	if route.Qos != nil {
+		qos = *route.Qos
+	}
+	retain := message.Retained()
+	if route.Retain != nil {
+		retain = *route.Retain
+	}
+
+	b.echoes.remember(bridgeEchoKey(toSide, topic, message.Payload()))
+
+	publishAsync(to, topic, qos, retain, message.Payload(), func(err error) {
+		if err != nil {
+			status("FWD", ERR, fmt.Sprintln("Failed to forward", message.Topic(), "to", toSide, topic, err))
+		} else if b.verbose {
+			status("FWD", OK, fmt.Sprintf("Forwarded %s to %s %s\n", message.Topic(), toSide, topic))
+		}
+	})
+}
@@ -0,0 +1,311 @@
+package plumber
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+)
+
+// Broker is a connection with its own watch list, feeding the shared
+// pipeline. Points from named brokers (--brokers) get a `broker` column.
+type Broker struct {
+	Name      string // empty for the single --broker
+	URI       string
+	Protocol  string
+	ClientID  string
+	Watch     []string // topic filters, without Prefix
+	Qos       byte
+	Prefix    string
+	Clean     bool
+	Sys       bool
+	Sparkplug bool
+
+	Group     string // scaling group shared with other instances, if any
+	GroupMode string
+
+	plumber *Plumber
+	client  Client
+	group   *Group
+}
+
+// Parse a comma-separated list of `name=uri[;option]` brokers, where options
+// are `watch:filter|filter`, `qos:n`, `prefix:topic`, `client-id:id`,
+// `protocol:version`, `clean:bool`, `sys:bool` and `sparkplug:bool`. Options
+// left out are taken from defaults (the flags), the client id gets the broker
+// name appended.
+func parseBrokers(spec string, defaults *Broker) ([]*Broker, error) {
+	var brokers []*Broker
+	names := make(map[string]bool)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) < 2 || len(name) == 0 {
+			return nil, fmt.Errorf("invalid broker %q (want name=uri[;option])", entry)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate broker name %q", name)
+		}
+		names[name] = true
+
+		b := *defaults
+		b.Name = name
+		b.ClientID = defaults.ClientID + "-" + name
+
+		options := strings.Split(parts[1], ";")
+		b.URI = strings.TrimSpace(options[0])
+		if len(b.URI) == 0 {
+			return nil, fmt.Errorf("missing uri for broker %q", name)
+		}
+
+		for _, option := range options[1:] {
+			kv := strings.SplitN(strings.TrimSpace(option), ":", 2)
+			if len(kv) < 2 {
+				return nil, fmt.Errorf("invalid option %q for broker %q", option, name)
+			}
+
+			switch arg := strings.TrimSpace(kv[1]); kv[0] {
+			case "watch":
+				b.Watch = strings.Split(arg, "|")
+			case "qos":
+				qos, err := strconv.ParseUint(arg, 10, 8)
+				if err != nil || qos > 2 {
+					return nil, fmt.Errorf("invalid qos %q for broker %q", arg, name)
+				}
+				b.Qos = byte(qos)
+			case "prefix":
+				b.Prefix = strings.Trim(arg, "/")
+			case "client-id":
+				b.ClientID = arg
+			case "protocol":
+				b.Protocol = arg
+			case "clean", "sys", "sparkplug":
+				flag, err := strconv.ParseBool(arg)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s %q for broker %q", kv[0], arg, name)
+				}
+				switch kv[0] {
+				case "clean":
+					b.Clean = flag
+				case "sys":
+					b.Sys = flag
+				default:
+					b.Sparkplug = flag
+				}
+			default:
+				return nil, fmt.Errorf("unknown option %q for broker %q", kv[0], name)
+			}
+		}
+
+		brokers = append(brokers, &b)
+	}
+	return brokers, nil
+}
+
+func (b *Broker) String() string {
+	if len(b.Name) == 0 {
+		return b.URI
+	}
+	return fmt.Sprintf("%s (%s)", b.Name, b.URI)
+}
+
+// Tag a point with the broker it came from
+func (b *Broker) tag(data map[string]interface{}) {
+	if len(b.Name) > 0 {
+		data["broker"] = b.Name
+	}
+}
+
+// Connect to the broker. A file store gets a subdirectory per named broker.
+func (b *Broker) Connect(store string) error {
+	opts := &ClientOptions{
+		Broker:   b.URI,
+		ClientID: b.ClientID,
+		Clean:    b.Clean,
+		Store:    store,
+	}
+
+	if len(store) > 0 && len(b.Name) > 0 {
+		opts.Store = filepath.Join(store, b.Name)
+	}
+
+	p := b.plumber
+	if p.config.Verbose {
+		opts.DefaultHandler = func(client *MQTT.Client, message MQTT.Message) {
+			p.onAnyMessageReceived(b, message)
+		}
+	}
+
+	if len(b.Group) > 0 {
+		b.group = NewGroup(b.Group, b.GroupMode, b.ClientID)
+		opts.Will = b.group.will()
+	}
+
+	client, err := p.dial(b.Protocol, opts)
+	if err != nil {
+		return fmt.Errorf("%s: %s", b, err)
+	}
+	b.client = client
+
+	status("OK", OK, fmt.Sprintf("Connected to %s as %s (MQTT %s)\n\n", b, b.ClientID, b.Protocol))
+
+	if b.group != nil && b.group.Mode == GroupAuto {
+		b.group.Mode = GroupHash
+		if client.SharedSubscriptions() {
+			b.group.Mode = GroupShared
+		}
+		status("GRP", INFO, fmt.Sprintf("Using %s mode for group %s on %s\n", b.group.Mode, b.Group, b))
+	}
+	return nil
+}
+
+// Whether this instance handles messages on the topic, rather than another
+// in its group
+func (b *Broker) owns(topic string) bool {
+	return b.group == nil || b.group.Owns(topic)
+}
+
+// Leave the group, if in one
+func (b *Broker) Leave() {
+	if b.group != nil {
+		b.group.Leave(b.client)
+	}
+}
+
+// Subscribe to $SYS (with Sys), Sparkplug (with Sparkplug) and the watch list,
+// after joining the group in hash mode
+func (b *Broker) Subscribe() error {
+	p := b.plumber
+	if b.group != nil && b.group.Mode == GroupHash {
+		if err := b.group.Join(b.client); err != nil {
+			return fmt.Errorf("%s: failed to join group %s: %s", b, b.Group, err)
+		}
+	}
+
+	if b.Sys {
+		status("", INFO, fmt.Sprintln("Subscribing to $SYS"))
+		handler := func(client *MQTT.Client, message MQTT.Message) {
+			p.onSysMessageReceived(b, message)
+		}
+		if err := b.client.Subscribe(b.share("$SYS/#"), b.Qos, handler); err != nil {
+			status("", ERR, fmt.Sprintln("Failed to subscribe to $SYS", err))
+			p.report(err)
+		}
+	}
+
+	if b.Sparkplug {
+		status("", INFO, fmt.Sprintln("Subscribing to Sparkplug"))
+		handler := func(client *MQTT.Client, message MQTT.Message) {
+			p.onSparkplugMessageReceived(b, message)
+		}
+		if err := b.client.Subscribe(b.share(sparkplugNamespace+"/#"), b.Qos, handler); err != nil {
+			status("", ERR, fmt.Sprintln("Failed to subscribe to Sparkplug", err))
+			p.report(err)
+		}
+	}
+
+	// Split watch list into array of topics
+	var topics []string
+	for i := range b.Watch {
+		topic := strings.TrimSpace(b.Watch[i])
+		if len(topic) == 0 {
+			status("ERR", ERR, fmt.Sprintf("Skipping empty watch topic at index %d\n", i))
+			continue
+		}
+
+		// Add prefix, if configured (after the group of shared subscriptions)
+		if len(b.Prefix) > 0 {
+			if group, filter := sharedFilter(topic); len(group) > 0 {
+				topic = strings.Join([]string{"$share", group, b.Prefix, filter}, "/")
+			} else {
+				topic = strings.Join([]string{b.Prefix, topic}, "/")
+			}
+		}
+
+		topics = append(topics, b.share(topic))
+	}
+
+	// Create subscriptions
+	if len(topics) > 0 {
+		b.subscribe(p.onTopicMessageReceived, topics...)
+	}
+	return nil
+}
+
+// Series the watch list is persisted to, the prefixed filters (shared
+// subscriptions under the plain filter)
+func (b *Broker) watchSeries() []string {
+	var series []string
+	for _, topic := range b.Watch {
+		_, filter := sharedFilter(strings.TrimSpace(topic))
+		if len(filter) == 0 {
+			continue
+		}
+		if len(b.Prefix) > 0 {
+			filter = b.Prefix + "/" + filter
+		}
+		series = append(series, filter)
+	}
+	return series
+}
+
+// Subscribe to topics
+func (b *Broker) subscribe(handler func(broker *Broker, message MQTT.Message, topic string), topics ...string) {
+	for i := range topics {
+		topic := topics[i]
+		if len(topic) == 0 {
+			if b.plumber.config.Verbose {
+				status("", WARN, fmt.Sprintf("Skipping empty topic at index %d\n", i))
+			}
+			continue
+		}
+
+		// Shared subscriptions are persisted under the plain filter
+		_, filter := sharedFilter(topic)
+		curried := func(client *MQTT.Client, message MQTT.Message) {
+			handler(b, message, filter)
+		}
+
+		if b.plumber.config.Verbose {
+			status("", INFO, fmt.Sprintln("Subscribing to", topic))
+		}
+
+		if err := b.client.Subscribe(topic, b.Qos, curried); err != nil {
+			status("", ERR, fmt.Sprintln("Failed to subscribe to", topic, err))
+			b.plumber.report(err)
+			return
+		}
+		status("OK", OK, fmt.Sprintln("Subscribed to", topic))
+		b.plumber.subscriptions = append(b.plumber.subscriptions, topic)
+	}
+	status("", INFO, "\n")
+}
+
+// Share a filter with the group in shared mode
+func (b *Broker) share(filter string) string {
+	if b.group == nil {
+		return filter
+	}
+	return b.group.share(filter)
+}
+
+func (b *Broker) unsubscribe(topics ...string) {
+	for i := range topics {
+		topic := topics[i]
+
+		if b.plumber.config.Verbose {
+			status("", INFO, fmt.Sprintln("Unsubscribing from", topic))
+		}
+		if err := b.client.Unsubscribe(topic); err != nil {
+			status("", ERR, fmt.Sprintln("Failed to unsubscribe from", topic, err))
+		}
+	}
+}
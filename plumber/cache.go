@@ -0,0 +1,134 @@
+package plumber
+
+import (
+	"container/list"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+)
+
+// LastValue is the latest message seen on a concrete topic
+type LastValue struct {
+	Broker   string          `json:"broker,omitempty"` // for named brokers
+	Topic    string          `json:"topic"`
+	Value    json.RawMessage `json:"value"`   // parsed payload
+	Payload  string          `json:"payload"` // raw payload
+	Received time.Time       `json:"received"`
+	Qos      byte            `json:"qos"`
+	Retained bool            `json:"retained"`
+	Expires  *time.Time      `json:"expires,omitempty"` // MQTT 5 message expiry
+}
+
+// Whether the value has outlived its message expiry interval
+func (v *LastValue) expired(now time.Time) bool {
+	return v.Expires != nil && now.After(*v.Expires)
+}
+
+// LastValueCache holds the last value per topic, evicting the least recently
+// updated topic once it holds more than size topics
+type LastValueCache struct {
+	sync.Mutex
+	size    int
+	order   *list.List // front is most recently updated
+	entries map[string]*list.Element
+}
+
+func NewLastValueCache(size int) *LastValueCache {
+	return &LastValueCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Entries are kept per broker and topic
+func (v *LastValue) key() string {
+	return v.Broker + " " + v.Topic
+}
+
+// Put stores the value as the latest for its topic
+func (c *LastValueCache) Put(value *LastValue) {
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.entries[value.key()]; ok {
+		el.Value = value
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[value.key()] = c.order.PushFront(value)
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*LastValue).key())
+	}
+}
+
+// Get returns the latest value on the broker's topic, or nil (also once it
+// expired)
+func (c *LastValueCache) Get(broker string, topic string) *LastValue {
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.entries[broker+" "+topic]; ok && !el.Value.(*LastValue).expired(time.Now()) {
+		return el.Value.(*LastValue)
+	}
+	return nil
+}
+
+// Match returns the latest unexpired values on all topics matching the topic
+// filter, ordered by broker and topic
+func (c *LastValueCache) Match(filter string) []*LastValue {
+	parser := Parse(filter)
+	now := time.Now()
+
+	c.Lock()
+	defer c.Unlock()
+
+	values := []*LastValue{}
+	for _, el := range c.entries {
+		value := el.Value.(*LastValue)
+		if parser.Match(value.Topic) && !value.expired(now) {
+			values = append(values, value)
+		}
+	}
+
+	sort.Sort(byTopic(values))
+	return values
+}
+
+type byTopic []*LastValue
+
+func (v byTopic) Len() int           { return len(v) }
+func (v byTopic) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v byTopic) Less(i, j int) bool { return v[i].key() < v[j].key() }
+
+// Remember the message and its parsed value as the latest on its topic
+func (p *Plumber) cacheLastValue(broker *Broker, message MQTT.Message, value []byte, received time.Time) {
+	if p.lastValues == nil {
+		return
+	}
+
+	// Values that aren't valid json would break encoding the whole response,
+	// keep the raw payload as a string instead
+	var check interface{}
+	if err := json.Unmarshal(value, &check); err != nil {
+		value, _ = json.Marshal(map[string]string{"value": string(message.Payload())})
+	}
+
+	p.lastValues.Put(&LastValue{
+		Broker:   broker.Name,
+		Topic:    message.Topic(),
+		Value:    json.RawMessage(value),
+		Payload:  string(message.Payload()),
+		Received: received,
+		Qos:      message.Qos(),
+		Retained: message.Retained(),
+		Expires:  messageExpires(message, received),
+	})
+}
@@ -0,0 +1,279 @@
+package plumber
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"math/big"
+	"time"
+)
+
+//
+// CBOR
+//
+
+// Tag some encoders start payloads with to mark them as CBOR
+var cborSelfDescribe = []byte{0xd9, 0xd9, 0xf7}
+
+// Marks the end of an indefinite length item
+var errCBORBreak = fmt.Errorf("unexpected cbor break")
+
+// A CBOR payload as the fields json would give: numbers are float64, byte
+// strings are base64 encoded and epoch dates are ISO-8601 strings
+func decodeCBOR(topic string, payload []byte) (map[string]interface{}, error) {
+	return decodeBinary(payload, (*binaryReader).cbor)
+}
+
+func (r *binaryReader) cbor() (interface{}, error) {
+	b, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	major, info := b>>5, b&0x1f
+
+	if major == 7 {
+		return r.cborSimple(info)
+	}
+
+	indefinite := info == 31
+	var n uint64
+	if !indefinite {
+		if n, err = r.cborArg(info); err != nil {
+			return nil, err
+		}
+	} else if major < 2 || major == 6 {
+		return nil, fmt.Errorf("invalid indefinite length cbor type %d", major)
+	}
+
+	switch major {
+	case 0:
+		return float64(n), nil
+	case 1:
+		return -1 - float64(n), nil
+	case 2, 3:
+		s, err := r.cborString(major, n, indefinite)
+		if err != nil {
+			return nil, err
+		}
+		if major == 2 {
+			return base64.StdEncoding.EncodeToString(s), nil
+		}
+		return string(s), nil
+	case 4:
+		return r.cborArray(n, indefinite)
+	case 5:
+		return r.cborMap(n, indefinite)
+	}
+	return r.cborTag(n)
+}
+
+// The length or value following an initial byte
+func (r *binaryReader) cborArg(info byte) (uint64, error) {
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info <= 27:
+		return r.uint(1 << (info - 24))
+	}
+	return 0, fmt.Errorf("invalid cbor additional info %d", info)
+}
+
+func (r *binaryReader) cborSimple(info byte) (interface{}, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		// null and undefined
+		return nil, nil
+	case 25:
+		bits, err := r.uint(2)
+		if err != nil {
+			return nil, err
+		}
+		return finite(halfFloat(uint16(bits))), nil
+	case 26:
+		bits, err := r.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return finite(float64(math.Float32frombits(uint32(bits)))), nil
+	case 27:
+		bits, err := r.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return finite(math.Float64frombits(bits)), nil
+	case 31:
+		return nil, errCBORBreak
+	}
+	return nil, fmt.Errorf("unsupported cbor simple value %d", info)
+}
+
+// IEEE 754 half precision
+func halfFloat(bits uint16) float64 {
+	exp := int(bits>>10) & 0x1f
+	mant := float64(bits & 0x3ff)
+
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+
+	if bits&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
+
+// A byte or text string, indefinite ones as the concatenation of their
+// definite chunks
+func (r *binaryReader) cborString(major byte, n uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		return r.next(n)
+	}
+
+	var s []byte
+	for {
+		b, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0xff {
+			return s, nil
+		}
+		if b>>5 != major || b&0x1f == 31 {
+			return nil, fmt.Errorf("invalid cbor string chunk 0x%02x", b)
+		}
+		n, err := r.cborArg(b & 0x1f)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := r.next(n)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, chunk...)
+	}
+}
+
+// Read an item of an indefinite length container, done at its break
+func (r *binaryReader) cborItem(indefinite bool) (value interface{}, done bool, err error) {
+	if indefinite && len(r.b) > 0 && r.b[0] == 0xff {
+		r.b = r.b[1:]
+		return nil, true, nil
+	}
+	value, err = r.cbor()
+	return value, false, err
+}
+
+func (r *binaryReader) cborArray(n uint64, indefinite bool) (interface{}, error) {
+	if indefinite {
+		n = 0
+	}
+	if err := r.container(n); err != nil {
+		return nil, err
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+
+	values := make([]interface{}, 0, n)
+	for i := uint64(0); indefinite || i < n; i++ {
+		value, done, err := r.cborItem(indefinite)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (r *binaryReader) cborMap(n uint64, indefinite bool) (interface{}, error) {
+	if indefinite {
+		n = 0
+	}
+	if err := r.container(n); err != nil {
+		return nil, err
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+
+	data := make(map[string]interface{}, n)
+	for i := uint64(0); indefinite || i < n; i++ {
+		key, done, err := r.cborItem(indefinite)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+		value, err := r.cbor()
+		if err != nil {
+			return nil, err
+		}
+		data[mapKey(key)] = value
+	}
+	return data, nil
+}
+
+// Tagged item, epoch dates become ISO-8601 strings and bignums numbers. Other
+// tags are dropped, keeping the item.
+func (r *binaryReader) cborTag(tag uint64) (interface{}, error) {
+	if (tag == 2 || tag == 3) && len(r.b) > 0 && r.b[0]>>5 == 2 {
+		return r.cborBignum(tag == 3)
+	}
+
+	if r.depth >= maxBinaryDepth {
+		return nil, fmt.Errorf("nested too deep")
+	}
+	r.depth++
+	value, err := r.cbor()
+	r.depth--
+	if err != nil {
+		return nil, err
+	}
+
+	if epoch, ok := value.(float64); ok && tag == 1 {
+		sec, frac := math.Modf(epoch)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC().Format(time.RFC3339Nano), nil
+	}
+	return value, nil
+}
+
+// Big-endian magnitude byte string of a bignum, negative ones are -1 - n
+func (r *binaryReader) cborBignum(negative bool) (interface{}, error) {
+	info := r.b[0] & 0x1f
+	r.b = r.b[1:]
+
+	var n uint64
+	var err error
+	indefinite := info == 31
+	if !indefinite {
+		if n, err = r.cborArg(info); err != nil {
+			return nil, err
+		}
+	}
+	b, err := r.cborString(2, n, indefinite)
+	if err != nil {
+		return nil, err
+	}
+
+	f, _ := new(big.Float).SetInt(new(big.Int).SetBytes(b)).Float64()
+	if negative {
+		f = -1 - f
+	}
+	return finite(f), nil
+}
@@ -0,0 +1,104 @@
+package plumber
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestCBORTypes(t *testing.T) {
+	for _, test := range []struct {
+		payload string
+		want    interface{}
+	}{
+		// Scalars end up under value, encodings from RFC 8949 appendix A
+		{"00", 0.0},
+		{"17", 23.0},
+		{"18 18", 24.0},
+		{"19 01 00", 256.0},
+		{"1a 00 0f 42 40", 1000000.0},
+		{"1b 00 00 00 e8 d4 a5 10 00", 1000000000000.0},
+		{"20", -1.0},
+		{"38 63", -100.0},
+		{"39 03 e7", -1000.0},
+		{"f9 3c 00", 1.0},
+		{"f9 c4 00", -4.0},
+		{"f9 7b ff", 65504.0},
+		{"f9 00 01", math.Ldexp(1, -24)},
+		{"f9 7c 00", nil}, // infinity
+		{"f9 7e 00", nil}, // NaN
+		{"fa 47 c3 50 00", 100000.0},
+		{"fb 3f f1 99 99 99 99 99 9a", 1.1},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"f7", nil},
+		{"43 01 02 03", "AQID"},
+		{"64 49 45 54 46", "IETF"},
+		{"83 01 02 03", []interface{}{1.0, 2.0, 3.0}},
+		{"80", []interface{}{}},
+
+		// Tags: epoch dates, bignums, and others dropped
+		{"c1 1a 51 4b 67 b0", "2013-03-21T20:04:00Z"},
+		{"c1 fb 41 d4 52 d9 ec 20 00 00", "2013-03-21T20:04:00.5Z"},
+		{"c2 49 01 00 00 00 00 00 00 00 00", 18446744073709551616.0},
+		{"c3 49 01 00 00 00 00 00 00 00 00", -18446744073709551617.0},
+		{"d8 20 63 61 62 63", "abc"},
+		{"d9 d9 f7 a1 61 61 01", map[string]interface{}{"a": 1.0}},
+
+		// Indefinite lengths
+		{"5f 42 01 02 43 03 04 05 ff", "AQIDBAU="},
+		{"7f 65 73 74 72 65 61 64 6d 69 6e 67 ff", "streaming"},
+		{"9f ff", []interface{}{}},
+		{"9f 01 82 02 03 9f 04 05 ff ff", []interface{}{1.0, []interface{}{2.0, 3.0}, []interface{}{4.0, 5.0}}},
+		{"bf 61 61 01 61 62 9f 02 03 ff ff", map[string]interface{}{"a": 1.0, "b": []interface{}{2.0, 3.0}}},
+
+		// Maps, with nesting and keys that aren't strings
+		{"a2 61 61 01 61 62 82 02 03", map[string]interface{}{"a": 1.0, "b": []interface{}{2.0, 3.0}}},
+		{"a1 61 61 a1 61 62 f6", map[string]interface{}{"a": map[string]interface{}{"b": nil}}},
+		{"a2 01 02 03 04", map[string]interface{}{"1": 2.0, "3": 4.0}},
+		{"a0", map[string]interface{}{}},
+	} {
+		data, err := decodeHex(t, decodeCBOR, test.payload)
+		if err != nil {
+			t.Errorf("%s: %s", test.payload, err)
+			continue
+		}
+		if want := objectFields(test.want); !reflect.DeepEqual(data, want) {
+			t.Errorf("%s = %#v, want %#v", test.payload, data, want)
+		}
+	}
+}
+
+func TestCBORInvalid(t *testing.T) {
+	for _, payload := range []string{
+		"",
+		"a1 61 61",                   // map value missing
+		"64 49 45",                   // short string
+		"19 01",                      // short uint16
+		"1c",                         // reserved additional info
+		"1f",                         // indefinite integer
+		"ff",                         // break outside a container
+		"f8 20",                      // unsupported simple value
+		"9b ff ff ff ff ff ff ff ff", // array longer than the payload
+		"bb ff ff ff ff ff ff ff ff", // map longer than the payload
+		"5b ff ff ff ff ff ff ff ff", // bytes longer than the payload
+		"5f 61 61 ff",                // text chunk in a byte string
+		"5f 42 01 02",                // indefinite bytes without a break
+		"9f 01 02",                   // indefinite array without a break
+		"bf 61 61 ff",                // indefinite map break before the value
+		"a1 61 61 01 02",             // trailing bytes
+		nestedHex("81 ", 65, "01"),   // nested too deep
+		nestedHex("9f ", 65, "ff"),
+		nestedHex("c6 ", 65, "01"), // tags too
+	} {
+		if data, err := decodeHex(t, decodeCBOR, payload); err == nil {
+			t.Errorf("%q decoded as %v", payload, data)
+		}
+	}
+
+	// As deep as allowed is fine
+	if _, err := decodeHex(t, decodeCBOR, nestedHex("81 ", 64, "01")); err != nil {
+		t.Error(err)
+	}
+}
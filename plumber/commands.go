@@ -0,0 +1,73 @@
+package plumber
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// Prompt commands
+//
+
+// Commands entered at the prompt as `:name args`
+func (p *Plumber) commands() map[string]func(args string) {
+	return map[string]func(args string){
+		"last": p.onLastCommand,
+	}
+}
+
+func (p *Plumber) onCommandReceived(in string) {
+	commands := p.commands()
+	parts := strings.SplitN(strings.TrimPrefix(in, ":"), " ", 2)
+	name := parts[0]
+	var args string
+	if len(parts) > 1 {
+		args = strings.TrimSpace(parts[1])
+	}
+
+	command, ok := commands[name]
+	if !ok {
+		var names []string
+		for name := range commands {
+			names = append(names, ":"+name)
+		}
+		sort.Strings(names)
+		status("CMD", ERR, fmt.Sprintf("Unknown command :%s (try %s)\n", name, strings.Join(names, ", ")))
+		return
+	}
+
+	command(args)
+}
+
+// :last [topic-filter]
+func (p *Plumber) onLastCommand(filter string) {
+	if p.lastValues == nil {
+		status("CMD", ERR, "Last value cache is disabled (--cache-size 0)\n")
+		return
+	}
+
+	if len(filter) == 0 {
+		filter = "#"
+	}
+
+	values := p.lastValues.Match(filter)
+	if len(values) == 0 {
+		status("LAST", WARN, fmt.Sprintf("Nothing cached matching %s\n", filter))
+		return
+	}
+
+	for _, value := range values {
+		age := time.Since(value.Received) / time.Second * time.Second
+		var retained string
+		if value.Retained {
+			retained = ", retained"
+		}
+		topic := value.Topic
+		if len(value.Broker) > 0 {
+			topic += " at " + value.Broker
+		}
+		status("LAST", INFO, fmt.Sprintf("%s (%s ago, qos %d%s) %s\n", topic, age, value.Qos, retained, value.Value))
+	}
+}
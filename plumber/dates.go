@@ -0,0 +1,101 @@
+package plumber
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mosquitto $SYS/broker/timestamp form (`date "+%F %T%z"`)
+const sysDateLayout = "2006-01-02 15:04:05-0700"
+
+// Pseudo layouts for unix epoch values
+var epochLayouts = map[string]time.Duration{
+	"epoch":    time.Second,
+	"epoch-ms": time.Millisecond,
+}
+
+// Short names usable in --date-layouts in place of a Go reference layout
+var namedDateLayouts = map[string]string{
+	"sys":      sysDateLayout,
+	"rfc3339":  time.RFC3339,
+	"rfc1123":  time.RFC1123,
+	"rfc1123z": time.RFC1123Z,
+	"epoch":    "epoch",
+	"epoch-ms": "epoch-ms",
+}
+
+// Layouts tried, in order, when a payload looks like a date
+var defaultDateLayouts = []string{
+	sysDateLayout,
+	time.RFC3339, // also accepts fractional seconds
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// Matcher for payloads that look like one of the above date forms
+var reDate = regexp.MustCompile(`^(?:[\d]{4}-[\d]{2}-[\d]{2}|(?:Mon|Tue|Wed|Thu|Fri|Sat|Sun), )`)
+
+// Parse a `layout|layout` date layouts rule value, e.g. "epoch-ms|rfc3339"
+func parseDateLayouts(value string) (interface{}, error) {
+	var layouts []string
+	for _, layout := range strings.Split(value, "|") {
+		layout = strings.TrimSpace(layout)
+		if len(layout) == 0 {
+			continue
+		}
+		if named, ok := namedDateLayouts[strings.ToLower(layout)]; ok {
+			layout = named
+		}
+		layouts = append(layouts, layout)
+	}
+
+	if len(layouts) == 0 {
+		return nil, fmt.Errorf("missing date layout")
+	}
+
+	return layouts, nil
+}
+
+// Parse a date using the first layout that fits
+func parseDate(layouts []string, value string) (time.Time, error) {
+	for _, layout := range layouts {
+		if unit, ok := epochLayouts[layout]; ok {
+			epoch, err := strconv.ParseFloat(value, 64)
+			if err == nil {
+				return time.Unix(0, int64(epoch*float64(unit))), nil
+			}
+			continue
+		}
+
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("no matching date layout for %q", value)
+}
+
+// Detect a date payload on the topic. The topic's configured layouts
+// (--date-layouts) are authoritative, otherwise anything that looks like a date
+// is tried against the default layouts. Dates that fail to parse are reported
+// through err, rather than being quietly turned into a zero time.
+func (p *Plumber) detectDate(topic string, value string) (t time.Time, ok bool, err error) {
+	if rule := p.dateLayoutRules.Match(topic); rule != nil {
+		t, err = parseDate(rule.Value.([]string), value)
+		return t, err == nil, err
+	}
+
+	if !reDate.MatchString(value) {
+		return time.Time{}, false, nil
+	}
+
+	t, err = parseDate(defaultDateLayouts, value)
+	return t, err == nil, err
+}
@@ -0,0 +1,403 @@
+package plumber
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+//
+// Payload decoders
+//
+
+// Decoder turns a payload into the fields of a point. Numbers should be
+// float64, as from encoding/json.
+type Decoder interface {
+	Decode(topic string, payload []byte) (map[string]interface{}, error)
+}
+
+// DecoderFunc adapts a function to the Decoder interface
+type DecoderFunc func(topic string, payload []byte) (map[string]interface{}, error)
+
+func (f DecoderFunc) Decode(topic string, payload []byte) (map[string]interface{}, error) {
+	return f(topic, payload)
+}
+
+// DecoderFactory makes a decoder from the argument in a --decoders rule,
+// `name:arg`, which is empty if left out
+type DecoderFactory func(arg string) (Decoder, error)
+
+var decoderRegistry = struct {
+	sync.RWMutex
+	factories map[string]DecoderFactory
+}{factories: map[string]DecoderFactory{
+	"json":      plainDecoder("json", DecoderFunc(decodeJSON)),
+	"msgpack":   plainDecoder("msgpack", DecoderFunc(decodeMsgpack)),
+	"cbor":      plainDecoder("cbor", DecoderFunc(decodeCBOR)),
+	"protobuf":  newProtobufDecoder,
+	"owntracks": newOwnTracksDecoder,
+	"scalar":    plainDecoder("scalar", DecoderFunc(decodeScalar)),
+	"logfmt":    plainDecoder("logfmt", DecoderFunc(decodeLogfmt)),
+	"csv":       newCSVDecoder,
+	"base64":    plainDecoder("base64", encodedDecoder(base64.StdEncoding.EncodeToString)),
+	"hex":       plainDecoder("hex", encodedDecoder(hex.EncodeToString)),
+}}
+
+// RegisterDecoder makes a decoder available to --decoders rules by name,
+// replacing any registered under the same name. Register before New.
+func RegisterDecoder(name string, factory DecoderFactory) {
+	decoderRegistry.Lock()
+	defer decoderRegistry.Unlock()
+	decoderRegistry.factories[name] = factory
+}
+
+// Names of the registered decoders, sorted
+func decoderNames() []string {
+	decoderRegistry.RLock()
+	defer decoderRegistry.RUnlock()
+
+	var names []string
+	for name := range decoderRegistry.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Factory for decoders that take no argument
+func plainDecoder(name string, d Decoder) DecoderFactory {
+	return func(arg string) (Decoder, error) {
+		if len(arg) > 0 {
+			return nil, fmt.Errorf("decoder %s takes no argument", name)
+		}
+		return d, nil
+	}
+}
+
+type namedDecoder struct {
+	name string
+	Decoder
+}
+
+// Parse a `name[:arg]|name[:arg]` decoders rule value, decoders to try in
+// order, e.g. "logfmt|scalar"
+func parseDecoders(value string) (interface{}, error) {
+	var chain []namedDecoder
+	for _, spec := range strings.Split(value, "|") {
+		spec = strings.TrimSpace(spec)
+		if len(spec) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(spec, ":", 2)
+		var arg string
+		if len(parts) > 1 {
+			arg = strings.TrimSpace(parts[1])
+		}
+
+		decoderRegistry.RLock()
+		factory, ok := decoderRegistry.factories[parts[0]]
+		decoderRegistry.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown decoder %q (want %s)", parts[0], strings.Join(decoderNames(), ", "))
+		}
+
+		decoder, err := factory(arg)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, namedDecoder{parts[0], decoder})
+	}
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("missing decoder")
+	}
+	return chain, nil
+}
+
+// Decode with the first decoder of the chain that takes the payload, as json
+// for normalizing
+func decodeChain(topic string, payload []byte, chain []namedDecoder) (jsonPayload []byte, name string, err error) {
+	for _, d := range chain {
+		var data map[string]interface{}
+		if data, err = d.Decode(topic, payload); err != nil {
+			continue
+		}
+		if jsonPayload, err = json.Marshal(data); err != nil {
+			continue
+		}
+		return jsonPayload, d.name, nil
+	}
+	return nil, "", err
+}
+
+//
+// Built in decoders
+//
+
+// Json objects as they are, other json values under `value`
+func decodeJSON(topic string, payload []byte) (map[string]interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return nil, err
+	}
+	return objectFields(value), nil
+}
+
+// Objects as their fields, other values under `value`
+func objectFields(value interface{}) map[string]interface{} {
+	if data, ok := value.(map[string]interface{}); ok {
+		return data
+	}
+	return map[string]interface{}{"value": value}
+}
+
+// A single number, boolean or string under `value`
+func decodeScalar(topic string, payload []byte) (map[string]interface{}, error) {
+	if !utf8.Valid(payload) {
+		return nil, fmt.Errorf("not text")
+	}
+	return map[string]interface{}{"value": scalar(strings.TrimSpace(string(payload)))}, nil
+}
+
+// Type a textual value: finite numbers and true/false, strings otherwise
+func scalar(s string) interface{} {
+	if n, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(n, 0) && !math.IsNaN(n) {
+		return n
+	}
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return s
+}
+
+// `key=value key="quoted value" flag` pairs, as logfmt. Bare keys are true.
+func decodeLogfmt(topic string, payload []byte) (map[string]interface{}, error) {
+	if !utf8.Valid(payload) {
+		return nil, fmt.Errorf("not text")
+	}
+
+	data := make(map[string]interface{})
+	s := strings.TrimSpace(string(payload))
+	for len(s) > 0 {
+		end := strings.IndexAny(s, "= \t")
+		if end < 0 {
+			end = len(s)
+		}
+		key := s[:end]
+		if len(key) == 0 {
+			return nil, fmt.Errorf("missing key at %q", s)
+		}
+		s = s[end:]
+
+		if len(s) == 0 || s[0] != '=' {
+			data[key] = true
+		} else if s = s[1:]; len(s) > 0 && s[0] == '"' {
+			end = quoteEnd(s)
+			value, err := strconv.Unquote(s[:end])
+			if err != nil {
+				return nil, fmt.Errorf("bad quoted value for %s", key)
+			}
+			data[key] = value
+			s = s[end:]
+		} else {
+			end = strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			data[key] = scalar(s[:end])
+			s = s[end:]
+		}
+
+		if len(s) > 0 && s[0] != ' ' && s[0] != '\t' {
+			return nil, fmt.Errorf("expected space after %s", key)
+		}
+		s = strings.TrimLeft(s, " \t")
+	}
+
+	if len(data) == 0 {
+		return nil, fmt.Errorf("no fields")
+	}
+	return data, nil
+}
+
+// Length of the quoted string at the start of s, up to the closing quote
+// (or all of s if there is none)
+func quoteEnd(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+// Parse a csv decoder argument, `column;column`. Without columns, fields are
+// named value1, value2 and so on.
+func newCSVDecoder(arg string) (Decoder, error) {
+	var columns []string
+	if len(arg) > 0 {
+		for _, column := range strings.Split(arg, ";") {
+			column = strings.TrimSpace(column)
+			if len(column) == 0 {
+				return nil, fmt.Errorf("empty csv column name in %q", arg)
+			}
+			columns = append(columns, column)
+		}
+	}
+
+	return DecoderFunc(func(topic string, payload []byte) (map[string]interface{}, error) {
+		if !utf8.Valid(payload) {
+			return nil, fmt.Errorf("not text")
+		}
+
+		// One line of csv
+		line := bytes.TrimSpace(payload)
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			return nil, fmt.Errorf("more than one line")
+		}
+		r := csv.NewReader(bytes.NewReader(line))
+		r.TrimLeadingSpace = true
+		record, err := r.Read()
+		if err != nil {
+			return nil, err
+		}
+		if len(columns) > 0 && len(record) != len(columns) {
+			return nil, fmt.Errorf("%d csv fields, want %d", len(record), len(columns))
+		}
+
+		data := make(map[string]interface{}, len(record))
+		for i, field := range record {
+			name := fmt.Sprintf("value%d", i+1)
+			if len(columns) > 0 {
+				name = columns[i]
+			}
+			data[name] = scalar(field)
+		}
+		return data, nil
+	}), nil
+}
+
+// The raw payload, encoded as text under `value`
+func encodedDecoder(encode func([]byte) string) Decoder {
+	return DecoderFunc(func(topic string, payload []byte) (map[string]interface{}, error) {
+		return map[string]interface{}{"value": encode(payload)}, nil
+	})
+}
+
+//
+// Binary formats
+//
+
+// Deepest nesting of arrays and maps a binary payload may have
+const maxBinaryDepth = 64
+
+// Reads big-endian values off the front of a binary payload
+type binaryReader struct {
+	b     []byte
+	depth int
+}
+
+func (r *binaryReader) next(n uint64) ([]byte, error) {
+	if n > uint64(len(r.b)) {
+		return nil, fmt.Errorf("truncated payload")
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b, nil
+}
+
+func (r *binaryReader) byte() (byte, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// An unsigned integer of n bytes
+func (r *binaryReader) uint(n uint64) (uint64, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// Check a container of n items fits in what's left (each item takes at least
+// a byte) before allocating for it
+func (r *binaryReader) container(n uint64) error {
+	if n > uint64(len(r.b)) {
+		return fmt.Errorf("truncated payload")
+	}
+	if r.depth >= maxBinaryDepth {
+		return fmt.Errorf("nested too deep")
+	}
+	return nil
+}
+
+// Json object keys are strings, other key types are formatted
+func mapKey(key interface{}) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
+
+// Decode a whole binary payload with read, which must consume all of it
+func decodeBinary(payload []byte, read func(r *binaryReader) (interface{}, error)) (map[string]interface{}, error) {
+	r := &binaryReader{b: payload}
+	value, err := read(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.b) > 0 {
+		return nil, fmt.Errorf("%d bytes after value", len(r.b))
+	}
+	return objectFields(value), nil
+}
+
+// Recognize MessagePack and CBOR maps that aren't text, as json for normalizing
+func detectBinary(payload []byte) (jsonPayload []byte, format string, ok bool) {
+	if len(payload) == 0 || utf8.Valid(payload) {
+		return nil, "", false
+	}
+
+	var decode func(topic string, payload []byte) (map[string]interface{}, error)
+	switch b := payload[0]; {
+	case b >= 0x80 && b <= 0x8f, b == 0xde, b == 0xdf:
+		decode, format = decodeMsgpack, "msgpack"
+	case b >= 0xa0 && b <= 0xbb, b == 0xbf, bytes.HasPrefix(payload, cborSelfDescribe):
+		decode, format = decodeCBOR, "cbor"
+	default:
+		return nil, "", false
+	}
+
+	data, err := decode("", payload)
+	if err != nil {
+		return nil, "", false
+	}
+	if jsonPayload, err = json.Marshal(data); err != nil {
+		return nil, "", false
+	}
+	return jsonPayload, format, true
+}
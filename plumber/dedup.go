@@ -0,0 +1,100 @@
+package plumber
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"fmt"
+	"sync"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+)
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+// Deduplicator drops messages already seen on the same topic within a time
+// window, keyed on a payload ID field when the topic's rule names one and on
+// a hash of the payload otherwise. Redeliveries after a reconnect and
+// retained re-sends often arrive without the DUP flag.
+type Deduplicator struct {
+	sync.Mutex
+	rules   Rules // topics to deduplicate, values are ID fields (or empty)
+	window  time.Duration
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // oldest first
+	dropped int
+}
+
+func NewDeduplicator(rules Rules, window time.Duration, size int) *Deduplicator {
+	return &Deduplicator{
+		rules:   rules,
+		window:  window,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Parse a dedup rule value, the optional payload ID field
+func parseDedupField(value string) (interface{}, error) {
+	return value, nil
+}
+
+// Seen reports whether the message is a duplicate of one from the same
+// broker, remembering it if not. Topics without a dedup rule are never
+// duplicates.
+func (d *Deduplicator) Seen(broker string, messageTopic string, payload []byte, data map[string]interface{}, now time.Time) bool {
+	rule := d.rules.Match(messageTopic)
+	if rule == nil {
+		return false
+	}
+
+	key := fmt.Sprintf("%s %s %x", broker, messageTopic, sha1.Sum(payload))
+	if field := rule.Value.(string); len(field) > 0 {
+		if id, ok := data[field]; ok {
+			key = fmt.Sprintf("%s %s id:%v", broker, messageTopic, id)
+		}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	// Forget what fell out of the window, or past the size bound
+	for el := d.order.Front(); el != nil; el = d.order.Front() {
+		entry := el.Value.(*dedupEntry)
+		if now.Sub(entry.seen) <= d.window && d.order.Len() < d.size {
+			break
+		}
+		d.order.Remove(el)
+		delete(d.entries, entry.key)
+	}
+
+	if _, ok := d.entries[key]; ok {
+		d.dropped++
+		return true
+	}
+
+	d.entries[key] = d.order.PushBack(&dedupEntry{key, now})
+	return false
+}
+
+// Dropped returns the number of duplicates dropped so far
+func (d *Deduplicator) Dropped() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.dropped
+}
+
+// Check the message against --dedup, reporting dropped duplicates
+func (p *Plumber) isDuplicate(broker *Broker, message MQTT.Message, data map[string]interface{}, received time.Time) bool {
+	if p.dedup == nil || !p.dedup.Seen(broker.Name, message.Topic(), message.Payload(), data, received) {
+		return false
+	}
+
+	status("SUB", WARN, fmt.Sprintf("Dropped repeated message on %s (%d duplicates so far)\n", message.Topic(), p.dedup.Dropped()))
+	return true
+}
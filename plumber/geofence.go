@@ -0,0 +1,362 @@
+package plumber
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Geofence events
+const (
+	geofenceEnter = "enter"
+	geofenceLeave = "leave"
+	geofenceDwell = "dwell"
+)
+
+// Series name prefix for geofence events, e.g. `geofence.home`
+const geofenceSeriesPrefix = "geofence."
+
+// Mean earth radius in meters
+const earthRadius = 6371008.8
+
+// Geofence is a named circle or polygon, with an optional dwell time after
+// which a device inside gets a dwell event
+type Geofence struct {
+	Name    string
+	Lat     float64 // circle center
+	Lon     float64
+	Radius  float64      // circle radius in meters, zero for polygons
+	Polygon [][2]float64 // lat, lon vertices
+	Dwell   time.Duration
+}
+
+// Parse a `name;circle:lat lon|radius` or `name;polygon:lat lon|lat lon|...`
+// geofence rule value, with an optional `;dwell:duration`, e.g.
+// "home;circle:52.52 13.405|150;dwell:10m"
+func parseGeofence(value string) (interface{}, error) {
+	options := strings.Split(value, ";")
+	fence := &Geofence{Name: strings.TrimSpace(options[0])}
+	if len(fence.Name) == 0 || strings.ContainsAny(fence.Name, "/+#") {
+		return nil, fmt.Errorf("invalid geofence name %q", fence.Name)
+	}
+
+	for _, option := range options[1:] {
+		kv := strings.SplitN(strings.TrimSpace(option), ":", 2)
+		if len(kv) < 2 {
+			return nil, fmt.Errorf("invalid geofence option %q", option)
+		}
+
+		switch arg := strings.TrimSpace(kv[1]); kv[0] {
+		case "circle":
+			parts := strings.Split(arg, "|")
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid circle %q (want lat lon|radius)", arg)
+			}
+			center, err := parseLatLon(parts[0])
+			if err != nil {
+				return nil, err
+			}
+			fence.Lat, fence.Lon = center[0], center[1]
+			if fence.Radius, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err != nil || fence.Radius <= 0 {
+				return nil, fmt.Errorf("invalid circle radius %q", parts[1])
+			}
+		case "polygon":
+			for _, vertex := range strings.Split(arg, "|") {
+				point, err := parseLatLon(vertex)
+				if err != nil {
+					return nil, err
+				}
+				fence.Polygon = append(fence.Polygon, point)
+			}
+			if len(fence.Polygon) < 3 {
+				return nil, fmt.Errorf("polygon needs at least 3 vertices in %q", arg)
+			}
+		case "dwell":
+			d, err := time.ParseDuration(arg)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid dwell duration %q", arg)
+			}
+			fence.Dwell = d
+		default:
+			return nil, fmt.Errorf("unknown geofence option %q", kv[0])
+		}
+	}
+
+	if fence.Radius == 0 && fence.Polygon == nil {
+		return nil, fmt.Errorf("geofence %s needs a circle or polygon", fence.Name)
+	}
+	if fence.Radius > 0 && fence.Polygon != nil {
+		return nil, fmt.Errorf("geofence %s is either a circle or a polygon", fence.Name)
+	}
+	return fence, nil
+}
+
+// Parse a `lat lon` point
+func parseLatLon(s string) ([2]float64, error) {
+	var point [2]float64
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return point, fmt.Errorf("invalid point %q (want lat lon)", s)
+	}
+	for i, field := range fields {
+		n, err := strconv.ParseFloat(field, 64)
+		if err != nil || math.Abs(n) > 90*float64(i+1) {
+			return point, fmt.Errorf("invalid point %q", s)
+		}
+		point[i] = n
+	}
+	return point, nil
+}
+
+// Contains reports whether the point is inside the fence
+func (f *Geofence) Contains(lat, lon float64) bool {
+	if f.Radius > 0 {
+		return distance(f.Lat, f.Lon, lat, lon) <= f.Radius
+	}
+
+	// Ray casting, on the lat/lon plane (fine at geofence sizes)
+	inside := false
+	for i, j := 0, len(f.Polygon)-1; i < len(f.Polygon); j, i = i, i+1 {
+		a, b := f.Polygon[i], f.Polygon[j]
+		if (a[0] > lat) != (b[0] > lat) && lon < (b[1]-a[1])*(lat-a[0])/(b[0]-a[0])+a[1] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Great circle distance in meters (haversine)
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Location fields of a point, `lat`/`lon` or `latitude`/`longitude`
+func location(data map[string]interface{}) (lat float64, lon float64, ok bool) {
+	for _, names := range [][2]string{{"lat", "lon"}, {"latitude", "longitude"}} {
+		lat, latOk := data[names[0]].(float64)
+		lon, lonOk := data[names[1]].(float64)
+		if latOk && lonOk {
+			return lat, lon, true
+		}
+	}
+	return 0, 0, false
+}
+
+// The device a location is from: the `user` and `device` fields (OwnTracks),
+// or the topic
+func locationDevice(messageTopic string, data map[string]interface{}) string {
+	user, _ := data["user"].(string)
+	device, _ := data["device"].(string)
+	switch {
+	case len(user) > 0 && len(device) > 0:
+		return user + "/" + device
+	case len(device) > 0:
+		return device
+	}
+	return messageTopic
+}
+
+// GeofenceEvent is written and published when a device enters, leaves or
+// dwells in a fence
+type GeofenceEvent struct {
+	Fence  string    `json:"fence"`
+	Event  string    `json:"event"`
+	Device string    `json:"device"`
+	Broker string    `json:"broker,omitempty"` // for named brokers
+	Topic  string    `json:"topic"`
+	Lat    float64   `json:"lat"`
+	Lon    float64   `json:"lon"`
+	Dwell  float64   `json:"dwell,omitempty"` // seconds inside, on leave and dwell
+	Time   time.Time `json:"time"`
+}
+
+// Where a device is relative to a fence
+type geofenceState struct {
+	fence   *Geofence
+	inside  bool
+	since   time.Time // of entering
+	seen    time.Time // last location
+	dwelled bool
+	last    GeofenceEvent // device, topic and location for dwell events
+}
+
+// Geofences tracks devices against geofence rules, writing and publishing
+// events as they enter, leave and dwell
+type Geofences struct {
+	sync.Mutex
+	rules   Rules
+	topic   string // MQTT topic prefix to publish events under, if any
+	publish func(topic string, payload []byte, done func(err error))
+	write   func(name string, data map[string]interface{}, t time.Time) error
+	states  map[string]*geofenceState
+
+	stop, done chan struct{}
+}
+
+func NewGeofences(rules Rules, topic string, publish func(topic string, payload []byte, done func(err error)), write func(name string, data map[string]interface{}, t time.Time) error) *Geofences {
+	return &Geofences{
+		rules:   rules,
+		topic:   topic,
+		publish: publish,
+		write:   write,
+		states:  make(map[string]*geofenceState),
+	}
+}
+
+// Check a location against every matching geofence. The first location of
+// a device only sets where it is, events are for changes after that.
+func (g *Geofences) Check(messageTopic string, data map[string]interface{}, t time.Time) {
+	lat, lon, ok := location(data)
+	if !ok || (len(g.topic) > 0 && strings.HasPrefix(messageTopic, g.topic+"/")) {
+		// Our own events carry locations too
+		return
+	}
+	broker, _ := data["broker"].(string)
+	device := locationDevice(messageTopic, data)
+	current := GeofenceEvent{Device: device, Broker: broker, Topic: messageTopic, Lat: lat, Lon: lon, Time: t}
+
+	var events []*GeofenceEvent
+	g.Lock()
+	for _, rule := range g.rules {
+		if !rule.Match(messageTopic) {
+			continue
+		}
+
+		fence := rule.Value.(*Geofence)
+		inside := fence.Contains(lat, lon)
+		key := rule.Filter + " " + fence.Name + " " + broker + " " + device
+		state := g.states[key]
+		if state == nil {
+			g.states[key] = &geofenceState{fence: fence, inside: inside, since: t, seen: t, last: current}
+			continue
+		}
+
+		// Late locations would flap
+		if t.Before(state.seen) {
+			continue
+		}
+		state.seen, state.last = t, current
+
+		switch {
+		case inside && !state.inside:
+			state.since, state.dwelled = t, false
+			events = append(events, state.event(geofenceEnter, t))
+		case !inside && state.inside:
+			events = append(events, state.event(geofenceLeave, t))
+		case inside && state.due(t):
+			state.dwelled = true
+			events = append(events, state.event(geofenceDwell, t))
+		}
+		state.inside = inside
+	}
+	g.Unlock()
+
+	for _, event := range events {
+		g.notify(event)
+	}
+}
+
+// Dwell events for devices that have been inside long enough, without
+// waiting for their next location
+func (g *Geofences) CheckDwell(now time.Time) {
+	var events []*GeofenceEvent
+
+	g.Lock()
+	for _, state := range g.states {
+		if state.inside && state.due(now) {
+			state.dwelled = true
+			events = append(events, state.event(geofenceDwell, now))
+		}
+	}
+	g.Unlock()
+
+	for _, event := range events {
+		g.notify(event)
+	}
+}
+
+// Check for dwelling every interval, in the background until Stop
+func (g *Geofences) Run(interval time.Duration) {
+	g.stop, g.done = make(chan struct{}), make(chan struct{})
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				g.CheckDwell(now)
+			case <-stop:
+				return
+			}
+		}
+	}(g.stop, g.done)
+}
+
+// Stop checking for dwelling, waiting for a check in progress
+func (g *Geofences) Stop() {
+	if g.stop == nil {
+		return
+	}
+	close(g.stop)
+	<-g.done
+	g.stop, g.done = nil, nil
+}
+
+// Whether a device inside is due its dwell event
+func (s *geofenceState) due(t time.Time) bool {
+	return s.fence.Dwell > 0 && !s.dwelled && t.Sub(s.since) >= s.fence.Dwell
+}
+
+func (s *geofenceState) event(name string, t time.Time) *GeofenceEvent {
+	event := s.last
+	event.Fence, event.Event, event.Time = s.fence.Name, name, t
+	if name != geofenceEnter {
+		event.Dwell = t.Sub(s.since).Seconds()
+	}
+	return &event
+}
+
+// Write the event as a point, and publish it (retained, so automations
+// starting up see where devices are) to `<topic>/<fence>/<device>`
+func (g *Geofences) notify(event *GeofenceEvent) {
+	status("GEO", INFO, fmt.Sprintf("%s %s %s\n", event.Device, event.Event, event.Fence))
+
+	data := map[string]interface{}{
+		"event":  event.Event,
+		"device": event.Device,
+		"topic":  event.Topic,
+		"lat":    event.Lat,
+		"lon":    event.Lon,
+	}
+	if event.Event != geofenceEnter {
+		data["dwell"] = event.Dwell
+	}
+	if len(event.Broker) > 0 {
+		data["broker"] = event.Broker
+	}
+	g.write(geofenceSeriesPrefix+event.Fence, data, event.Time)
+
+	if len(g.topic) == 0 {
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		status("GEO", ERR, fmt.Sprintln("Failed to encode geofence event", err))
+		return
+	}
+	pubTopic := strings.Join([]string{g.topic, event.Fence, event.Device}, "/")
+	g.publish(pubTopic, payload, func(err error) {
+		if err != nil {
+			status("GEO", ERR, fmt.Sprintln("Failed to publish geofence event to", pubTopic, err))
+		}
+	})
+}
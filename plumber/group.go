@@ -0,0 +1,241 @@
+package plumber
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"github.com/impressiver/mqtt-plumber/mqtt5"
+)
+
+//
+// Scaling groups
+//
+
+// How instances in a group split the watch list
+const (
+	GroupAuto   = "auto"   // shared if the broker says it supports them, hash otherwise
+	GroupShared = "shared" // $share/<group>/ subscriptions, the broker picks an instance per message
+	GroupHash   = "hash"   // every instance subscribes, each persists the topics it owns
+)
+
+const (
+	groupTopic     = "plumber/groups" // membership messages go to groupTopic/<group>/<client id>
+	groupHeartbeat = 10 * time.Second
+	groupTimeout   = 3 * groupHeartbeat // members not heard from in this long have left
+	groupReplicas  = 100                // points per member on the hash ring
+)
+
+// Membership message, retained so instances joining later see the group
+type Member struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+type ringPoint struct {
+	hash uint32
+	id   string
+}
+
+// Group is one instance's view of the instances sharing a watch list on a
+// broker. In hash mode, topics are split among members with consistent
+// hashing, so a member joining or leaving only moves its share of them.
+type Group struct {
+	Name string
+	Mode string
+	id   string // our client id
+
+	sync.Mutex
+	members map[string]time.Time // last heard from, by client id
+	ring    []ringPoint
+	stop    chan struct{}
+}
+
+func checkGroupMode(mode string) error {
+	switch mode {
+	case GroupAuto, GroupShared, GroupHash:
+		return nil
+	}
+	return fmt.Errorf("unknown group mode %q (want %s, %s or %s)", mode, GroupAuto, GroupShared, GroupHash)
+}
+
+func NewGroup(name string, mode string, id string) *Group {
+	g := &Group{Name: name, Mode: mode, id: id, members: make(map[string]time.Time)}
+	g.members[id] = time.Now()
+	g.build()
+	return g
+}
+
+// Membership topic of a client
+func (g *Group) topic(id string) string {
+	return strings.Join([]string{groupTopic, g.Name, id}, "/")
+}
+
+// Will that clears our membership if the connection drops
+func (g *Group) will() *mqtt5.Will {
+	return &mqtt5.Will{Topic: g.topic(g.id), Qos: 1, Retained: true}
+}
+
+// Share a watch filter among the group, unless it already is
+func (g *Group) share(filter string) string {
+	if group, _ := sharedFilter(filter); g.Mode != GroupShared || len(group) > 0 {
+		return filter
+	}
+	return strings.Join([]string{"$share", g.Name, filter}, "/")
+}
+
+// Join the group: follow membership, announce ourselves and keep doing so
+// until Leave. Only needed in hash mode.
+func (g *Group) Join(client Client) error {
+	handler := func(c *MQTT.Client, message MQTT.Message) {
+		g.onMembership(message, time.Now())
+	}
+	if err := client.Subscribe(g.topic("+"), 1, handler); err != nil {
+		return err
+	}
+	if err := g.announce(client, true); err != nil {
+		return err
+	}
+
+	g.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(groupHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				g.announce(client, false)
+				g.expire(now)
+			case <-g.stop:
+				return
+			}
+		}
+	}()
+
+	status("GRP", OK, fmt.Sprintf("Joined group %s as %s\n", g.Name, g.id))
+	return nil
+}
+
+// Leave the group, clearing our membership so the others take over our
+// topics without waiting for the timeout
+func (g *Group) Leave(client Client) {
+	if g.stop == nil {
+		return
+	}
+	close(g.stop)
+	g.stop = nil
+	if err := publishWait(client, g.topic(g.id), 1, true, []byte{}); err != nil {
+		status("GRP", ERR, fmt.Sprintln("Failed to leave group", g.Name, err))
+	}
+}
+
+func (g *Group) announce(client Client, wait bool) error {
+	payload, err := json.Marshal(&Member{ID: g.id, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	if wait {
+		return publishWait(client, g.topic(g.id), 1, true, payload)
+	}
+	client.Publish(g.topic(g.id), 1, true, payload, nil, func(err error) {
+		if err != nil {
+			status("GRP", ERR, fmt.Sprintln("Failed to announce group membership", err))
+		}
+	})
+	return nil
+}
+
+// Track a membership message, an empty payload is a member leaving. Members
+// are timed by when we hear from them, their clocks may be off.
+func (g *Group) onMembership(message MQTT.Message, received time.Time) {
+	id := message.Topic()[len(g.topic("")):]
+	if id == g.id {
+		return
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	_, known := g.members[id]
+	if len(message.Payload()) == 0 {
+		if known {
+			delete(g.members, id)
+			g.changed(fmt.Sprintf("%s left", id))
+		}
+		return
+	}
+
+	var member Member
+	if err := json.Unmarshal(message.Payload(), &member); err != nil {
+		status("GRP", ERR, fmt.Sprintf("Invalid membership message on %s: %s\n", message.Topic(), err))
+		return
+	}
+	g.members[id] = received
+	if !known {
+		g.changed(fmt.Sprintf("%s joined", id))
+	}
+}
+
+// Drop members we haven't heard from in a while
+func (g *Group) expire(now time.Time) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.members[g.id] = now
+	for id, seen := range g.members {
+		if now.Sub(seen) > groupTimeout {
+			delete(g.members, id)
+			g.changed(fmt.Sprintf("%s timed out", id))
+		}
+	}
+}
+
+// Rebuild the ring after a membership change. Call with the lock held.
+func (g *Group) changed(why string) {
+	g.build()
+	status("GRP", INFO, fmt.Sprintf("Group %s: %s, %d members\n", g.Name, why, len(g.members)))
+}
+
+func (g *Group) build() {
+	g.ring = g.ring[:0]
+	for id := range g.members {
+		for i := 0; i < groupReplicas; i++ {
+			g.ring = append(g.ring, ringPoint{crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", id, i))), id})
+		}
+	}
+	sort.Sort(byHash(g.ring))
+}
+
+// Owner of a topic, the first member clockwise of its hash on the ring
+func (g *Group) Owner(topic string) string {
+	g.Lock()
+	defer g.Unlock()
+
+	hash := crc32.ChecksumIEEE([]byte(topic))
+	i := sort.Search(len(g.ring), func(i int) bool { return g.ring[i].hash >= hash })
+	if i == len(g.ring) {
+		i = 0
+	}
+	return g.ring[i].id
+}
+
+// Owns reports whether this instance handles messages on the topic
+func (g *Group) Owns(topic string) bool {
+	return g.Mode != GroupHash || g.Owner(topic) == g.id
+}
+
+type byHash []ringPoint
+
+func (r byHash) Len() int      { return len(r) }
+func (r byHash) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byHash) Less(i, j int) bool {
+	if r[i].hash != r[j].hash {
+		return r[i].hash < r[j].hash
+	}
+	return r[i].id < r[j].id
+}
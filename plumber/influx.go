@@ -0,0 +1,111 @@
+package plumber
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	influx "github.com/influxdb/influxdb/client"
+)
+
+// InfluxSink writes points to InfluxDB, one series per watched topic
+type InfluxSink struct {
+	client *influx.Client
+}
+
+func NewInfluxSink(config *influx.ClientConfig) (*InfluxSink, error) {
+	client, err := influx.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &InfluxSink{client}, nil
+}
+
+// Client for queries
+func (s *InfluxSink) Client() *influx.Client {
+	return s.client
+}
+
+// Write a single point to the named series
+func (s *InfluxSink) Write(name string, data map[string]interface{}, t time.Time) error {
+	// Split map into key/value arrays
+	var keys []string
+	var values []interface{}
+	for key, value := range data {
+		if key == "time" {
+			continue
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+
+	// Explicit point time, so buffered and retained messages land where they
+	// belong instead of at write time. It's InfluxDB's own time column, a
+	// payload field of that name can't be stored.
+	keys = append(keys, "time")
+	values = append(values, t.UnixNano()/int64(time.Millisecond))
+
+	// Create series for the topic, with keys for columns and values for points
+	series := &influx.Series{
+		Name:    name,
+		Columns: keys,
+		Points: [][]interface{}{
+			values,
+		},
+	}
+
+	return s.client.WriteSeriesWithTimePrecision([]*influx.Series{series}, influx.Millisecond)
+}
+
+// Read at most limit points of a series between from and to, oldest first
+func (s *InfluxSink) Read(series string, from, to time.Time, limit int) ([]*StoredPoint, error) {
+	if strings.Contains(series, `"`) {
+		return nil, fmt.Errorf("invalid series name %q", series)
+	}
+	query := fmt.Sprintf(`select * from "%s" where time > %du and time < %du order asc limit %d`,
+		series, from.UnixNano()/int64(time.Microsecond), to.UnixNano()/int64(time.Microsecond), limit)
+	result, err := s.client.Query(query, influx.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+
+	var points []*StoredPoint
+	for _, series := range result {
+		for _, values := range series.Points {
+			point := &StoredPoint{Data: make(map[string]interface{})}
+			for i, column := range series.Columns {
+				if i >= len(values) || values[i] == nil {
+					continue
+				}
+				switch column {
+				case "time":
+					ms, _ := values[i].(float64)
+					point.Time = time.Unix(0, int64(ms)*int64(time.Millisecond))
+				case "sequence_number":
+				default:
+					point.Data[column] = values[i]
+				}
+			}
+			points = append(points, point)
+		}
+	}
+	return points, nil
+}
+
+// Run an InfluxDB 0.8 query, times in milliseconds
+func (s *InfluxSink) Query(query string) ([]*QuerySeries, error) {
+	result, err := s.client.Query(query, influx.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+
+	series := []*QuerySeries{}
+	for _, r := range result {
+		values := r.Points
+		if values == nil {
+			values = [][]interface{}{}
+		}
+		series = append(series, &QuerySeries{Name: r.Name, Columns: r.Columns, Values: values})
+	}
+	return series, nil
+}
@@ -0,0 +1,203 @@
+package plumber
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"time"
+)
+
+//
+// MessagePack
+//
+
+// Ext type of MessagePack timestamps
+const msgpackTimestamp = -1
+
+// A MessagePack payload as the fields json would give: numbers are float64,
+// binary is base64 encoded and timestamps are ISO-8601 strings
+func decodeMsgpack(topic string, payload []byte) (map[string]interface{}, error) {
+	return decodeBinary(payload, (*binaryReader).msgpack)
+}
+
+func (r *binaryReader) msgpack() (interface{}, error) {
+	b, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case b <= 0x7f:
+		return float64(b), nil
+	case b >= 0xe0:
+		return float64(int8(b)), nil
+	case b <= 0x8f:
+		return r.msgpackMap(uint64(b & 0x0f))
+	case b <= 0x9f:
+		return r.msgpackArray(uint64(b & 0x0f))
+	case b <= 0xbf:
+		return r.msgpackString(uint64(b & 0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.uint(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.EncodeToString(data), nil
+	case 0xc7, 0xc8, 0xc9:
+		n, err := r.uint(1 << (b - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackExt(n)
+	case 0xca:
+		bits, err := r.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return finite(float64(math.Float32frombits(uint32(bits)))), nil
+	case 0xcb:
+		bits, err := r.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return finite(math.Float64frombits(bits)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := r.uint(1 << (b - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return float64(v), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		n := uint64(1) << (b - 0xd0)
+		v, err := r.uint(n)
+		if err != nil {
+			return nil, err
+		}
+		// Sign extend
+		shift := 64 - 8*n
+		return float64(int64(v<<shift) >> shift), nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return r.msgpackExt(1 << (b - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.uint(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackString(n)
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackArray(n)
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.msgpackMap(n)
+	}
+
+	return nil, fmt.Errorf("invalid msgpack type 0x%02x", b)
+}
+
+func (r *binaryReader) msgpackString(n uint64) (interface{}, error) {
+	s, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(s), nil
+}
+
+func (r *binaryReader) msgpackArray(n uint64) (interface{}, error) {
+	if err := r.container(n); err != nil {
+		return nil, err
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+
+	values := make([]interface{}, n)
+	for i := range values {
+		value, err := r.msgpack()
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func (r *binaryReader) msgpackMap(n uint64) (interface{}, error) {
+	if err := r.container(n); err != nil {
+		return nil, err
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+
+	data := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		key, err := r.msgpack()
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.msgpack()
+		if err != nil {
+			return nil, err
+		}
+		data[mapKey(key)] = value
+	}
+	return data, nil
+}
+
+// Extension of n data bytes, timestamps become dates and others are kept
+// base64 encoded
+func (r *binaryReader) msgpackExt(n uint64) (interface{}, error) {
+	typ, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+	if int8(typ) != msgpackTimestamp {
+		return base64.StdEncoding.EncodeToString(data), nil
+	}
+
+	ext := &binaryReader{b: data}
+	var sec, nsec uint64
+	switch n {
+	case 4:
+		sec, _ = ext.uint(4)
+	case 8:
+		v, _ := ext.uint(8)
+		nsec, sec = v>>34, v&(1<<34-1)
+	case 12:
+		nsec, _ = ext.uint(4)
+		sec, _ = ext.uint(8)
+	default:
+		return nil, fmt.Errorf("invalid msgpack timestamp length %d", n)
+	}
+	return time.Unix(int64(sec), int64(nsec)).UTC().Format(time.RFC3339Nano), nil
+}
+
+// Json has no NaN or infinities, they're kept as null
+func finite(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	return f
+}
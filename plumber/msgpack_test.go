@@ -0,0 +1,110 @@
+package plumber
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Decode a hex payload, spaces allowed
+func decodeHex(t *testing.T, decode func(topic string, payload []byte) (map[string]interface{}, error), s string) (map[string]interface{}, error) {
+	payload, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decode("sensors/a", payload)
+}
+
+// Nested containers n deep around a final byte
+func nestedHex(open string, n int, last string) string {
+	return strings.Repeat(open, n) + last
+}
+
+func TestMsgpackTypes(t *testing.T) {
+	for _, test := range []struct {
+		payload string
+		want    interface{}
+	}{
+		// Scalars end up under value
+		{"00", 0.0},
+		{"7f", 127.0},
+		{"e0", -32.0},
+		{"ff", -1.0},
+		{"c0", nil},
+		{"c2", false},
+		{"c3", true},
+		{"cc ff", 255.0},
+		{"cd 01 00", 256.0},
+		{"ce 00 01 00 00", 65536.0},
+		{"cf 00 00 00 01 00 00 00 00", 4294967296.0},
+		{"d0 80", -128.0},
+		{"d1 ff 00", -256.0},
+		{"d2 ff ff ff ff", -1.0},
+		{"d3 ff ff ff ff ff ff ff fe", -2.0},
+		{"ca 3f c0 00 00", 1.5},
+		{"cb 3f f8 00 00 00 00 00 00", 1.5},
+		{"cb 7f f8 00 00 00 00 00 00", nil}, // NaN
+		{"a3 61 62 63", "abc"},
+		{"d9 03 61 62 63", "abc"},
+		{"da 00 03 61 62 63", "abc"},
+		{"db 00 00 00 03 61 62 63", "abc"},
+		{"c4 03 01 02 03", "AQID"},
+		{"c5 00 03 01 02 03", "AQID"},
+		{"c6 00 00 00 03 01 02 03", "AQID"},
+		{"92 01 a1 61", []interface{}{1.0, "a"}},
+		{"dc 00 02 01 02", []interface{}{1.0, 2.0}},
+		{"dd 00 00 00 01 c3", []interface{}{true}},
+		{"90", []interface{}{}},
+
+		// Extensions, timestamps as dates
+		{"d4 05 aa", "qg=="},
+		{"c7 02 05 aa bb", "qrs="},
+		{"d6 ff 00 00 00 01", "1970-01-01T00:00:01Z"},
+		{"d7 ff 77 35 94 00 00 00 00 01", "1970-01-01T00:00:01.5Z"},
+		{"c7 0c ff 1d cd 65 00 00 00 00 00 00 00 00 01", "1970-01-01T00:00:01.5Z"},
+
+		// Maps, with nesting and keys that aren't strings
+		{"81 a1 61 01", map[string]interface{}{"a": 1.0}},
+		{"82 a1 61 81 a1 62 92 01 02 a1 63 c0", map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{1.0, 2.0}}, "c": nil}},
+		{"81 01 02", map[string]interface{}{"1": 2.0}},
+		{"de 00 01 a1 61 01", map[string]interface{}{"a": 1.0}},
+		{"df 00 00 00 01 a1 61 01", map[string]interface{}{"a": 1.0}},
+		{"80", map[string]interface{}{}},
+	} {
+		data, err := decodeHex(t, decodeMsgpack, test.payload)
+		if err != nil {
+			t.Errorf("%s: %s", test.payload, err)
+			continue
+		}
+		if want := objectFields(test.want); !reflect.DeepEqual(data, want) {
+			t.Errorf("%s = %#v, want %#v", test.payload, data, want)
+		}
+	}
+}
+
+func TestMsgpackInvalid(t *testing.T) {
+	for _, payload := range []string{
+		"",
+		"c1",                      // never used
+		"81 a1 61",                // map value missing
+		"a3 61 62",                // short string
+		"cd 01",                   // short uint16
+		"dd ff ff ff ff 01",       // array longer than the payload
+		"df ff ff ff ff",          // map longer than the payload
+		"c6 ff ff ff ff",          // binary longer than the payload
+		"d5 ff 00 00",             // timestamp of 2 bytes
+		"81 a1 61 01 02",          // trailing bytes
+		nestedHex("91", 65, "01"), // nested too deep
+		nestedHex("81 a1 61 ", 65, "01"),
+	} {
+		if data, err := decodeHex(t, decodeMsgpack, payload); err == nil {
+			t.Errorf("%q decoded as %v", payload, data)
+		}
+	}
+
+	// As deep as allowed is fine
+	if _, err := decodeHex(t, decodeMsgpack, nestedHex("91", 64, "01")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,182 @@
+package plumber
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+//
+// OwnTracks
+//
+
+// Numeric OwnTracks fields, some apps and versions send them as strings
+var ownTracksNumbers = map[string]bool{
+	"tst": true, "wtst": true, "created_at": true,
+	"lat": true, "lon": true, "alt": true, "acc": true, "vac": true,
+	"vel": true, "cog": true, "rad": true, "p": true, "dist": true,
+	"batt": true, "bs": true, "m": true,
+	"major": true, "minor": true, "rssi": true, "prox": true,
+}
+
+// Location report triggers, `t`
+var ownTracksTriggers = map[string]string{
+	"p": "ping",
+	"c": "region",
+	"C": "follow",
+	"b": "beacon",
+	"r": "response",
+	"u": "manual",
+	"t": "timer",
+	"v": "monitoring",
+}
+
+// Topic levels after the device, for events, waypoints, cards and such
+var ownTracksSuffixes = map[string]bool{
+	"event": true, "waypoint": true, "waypoints": true, "info": true,
+	"cmd": true, "dump": true, "status": true, "steps": true, "beacon": true,
+}
+
+// Sizes of the secretbox key and nonce in encrypted payloads
+const (
+	ownTracksKeySize   = 32
+	ownTracksNonceSize = 24
+)
+
+type ownTracksDecoder struct {
+	key *[ownTracksKeySize]byte // nil without a secret
+}
+
+// Parse an owntracks decoder argument, the secret for encrypted payloads or
+// `@path` to read it from a file. Like the apps, the secret is the key,
+// zero-padded (or cut) to 32 bytes.
+func newOwnTracksDecoder(arg string) (Decoder, error) {
+	secret := arg
+	if strings.HasPrefix(arg, "@") {
+		b, err := ioutil.ReadFile(arg[1:])
+		if err != nil {
+			return nil, err
+		}
+		secret = strings.TrimRight(string(b), "\r\n")
+	}
+
+	d := &ownTracksDecoder{}
+	if len(secret) > 0 {
+		d.key = new([ownTracksKeySize]byte)
+		copy(d.key[:], secret)
+	}
+	return d, nil
+}
+
+// An OwnTracks json payload with typed fields, tagged with the `user` and
+// `device` of its topic, `owntracks/<user>/<device>[/event]`
+func (d *ownTracksDecoder) Decode(topic string, payload []byte) (map[string]interface{}, error) {
+	data, err := d.decode(payload, false)
+	if err != nil {
+		return nil, err
+	}
+
+	levels := strings.Split(topic, "/")
+	if n := len(levels); n > 3 && ownTracksSuffixes[levels[n-1]] {
+		levels = levels[:n-1]
+	}
+	if n := len(levels); n >= 3 {
+		for key, value := range map[string]string{"user": levels[n-2], "device": levels[n-1]} {
+			if _, ok := data[key]; !ok {
+				data[key] = value
+			}
+		}
+	}
+	return data, nil
+}
+
+func (d *ownTracksDecoder) decode(payload []byte, decrypted bool) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return nil, err
+	}
+	typ, _ := data["_type"].(string)
+	if len(typ) == 0 {
+		return nil, fmt.Errorf("not an OwnTracks payload, no _type")
+	}
+
+	if typ == "encrypted" {
+		if decrypted {
+			return nil, fmt.Errorf("encrypted OwnTracks payload inside another")
+		}
+		plaintext, err := d.decrypt(data["data"])
+		if err != nil {
+			return nil, err
+		}
+		if data, err = d.decode(plaintext, true); err != nil {
+			return nil, err
+		}
+		data["encrypted"] = true
+		return data, nil
+	}
+
+	for key, value := range data {
+		if s, ok := value.(string); ok && ownTracksNumbers[key] {
+			if n, err := strconv.ParseFloat(s, 64); err == nil {
+				data[key] = n
+			}
+		}
+	}
+
+	switch typ {
+	case "location":
+		if t, ok := data["t"].(string); ok && len(ownTracksTriggers[t]) > 0 {
+			data["trigger"] = ownTracksTriggers[t]
+		}
+		// Regions the device is in, joined like topic params
+		for _, key := range []string{"inregions", "inrids"} {
+			if regions, ok := data[key].([]interface{}); ok {
+				var names []string
+				for _, region := range regions {
+					names = append(names, fmt.Sprint(region))
+				}
+				data[key] = strings.Join(names, ", ")
+			}
+		}
+	case "card":
+		// The face is a base64 image, not something to keep a series of
+		delete(data, "face")
+	case "waypoints":
+		if waypoints, ok := data["waypoints"].([]interface{}); ok {
+			data["waypoints"] = float64(len(waypoints))
+		}
+	}
+	return data, nil
+}
+
+// Open the base64 `data` of an encrypted payload, the nonce followed by the
+// secretbox
+func (d *ownTracksDecoder) decrypt(value interface{}) ([]byte, error) {
+	if d.key == nil {
+		return nil, fmt.Errorf("encrypted OwnTracks payload, but no secret is configured")
+	}
+	encoded, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("encrypted OwnTracks payload without data")
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < ownTracksNonceSize+secretbox.Overhead {
+		return nil, fmt.Errorf("encrypted OwnTracks data too short")
+	}
+
+	var nonce [ownTracksNonceSize]byte
+	copy(nonce[:], b)
+	message, ok := secretbox.Open(nil, b[ownTracksNonceSize:], &nonce, d.key)
+	if !ok {
+		return nil, fmt.Errorf("encrypted OwnTracks data failed to authenticate (wrong secret?)")
+	}
+	return message, nil
+}
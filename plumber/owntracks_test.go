@@ -0,0 +1,34 @@
+package plumber
+
+import (
+	"testing"
+)
+
+// A location encrypted by the apps' secretbox (NaCl XSalsa20-Poly1305) with
+// the secret "s3cret"
+const ownTracksEncrypted = `{"_type":"encrypted","data":"AAcOFRwjKjE4P0ZNVFtiaXB3foWMk5qhFemGADW3jNKs2zOzGdfi8l0PD7QkQlJo3VPrvJXNuaTw0rCZi5eMhRuHoBkO3F0twInNRtMTnz/0QNAgFMyzNHBeDIMOz9tBZy/jmtOc+iB/ZQ1gri/unrn3ixsUJWTcPt4JI9sY1BCDSVw0In9aFh6mrqXkrxPz7Jb8h9OCqlbP89tuK0jv1OA="}`
+
+func TestOwnTracksEncrypted(t *testing.T) {
+	d, err := newOwnTracksDecoder("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := d.Decode("owntracks/user1/phone", []byte(ownTracksEncrypted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["encrypted"] != true || data["tst"] != 1700000000.0 || data["batt"] != 87.0 || data["trigger"] != "manual" || data["inregions"] != "home, work" {
+		t.Errorf("data = %v", data)
+	}
+	if data["user"] != "user1" || data["device"] != "phone" {
+		t.Errorf("user and device = %v, %v", data["user"], data["device"])
+	}
+
+	// A wrong secret fails to authenticate, no secret can't decrypt
+	for _, secret := range []string{"wrong", ""} {
+		d, _ := newOwnTracksDecoder(secret)
+		if data, err := d.Decode("owntracks/user1/phone", []byte(ownTracksEncrypted)); err == nil {
+			t.Errorf("secret %q decoded %v", secret, data)
+		}
+	}
+}
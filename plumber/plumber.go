@@ -0,0 +1,768 @@
+// Package plumber watches MQTT topics and persists what it sees: payloads are
+// parsed, normalized into points and written to a Sink, with caching,
+// rollups, alerts, webhooks and republishing along the way.
+//
+// The mqtt-plumber command is a thin CLI over it. To embed it, build a Config,
+// pick a Sink and start it:
+//
+//	sink, err := plumber.NewInfluxSink(&influx.ClientConfig{Database: "mqtt_plumber"})
+//	p, err := plumber.New(plumber.Config{Broker: "tcp://localhost:1883", Watch: []string{"sensors/#"}}, sink)
+//	p.Hooks.Persisted = func(series string, data map[string]interface{}, t time.Time) { ... }
+//	err = p.Start()
+//	defer p.Stop()
+//
+// Handlers can be tested without a broker by setting Config.Dial to return a
+// fake Client, and calling the handlers it is given.
+package plumber
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"github.com/impressiver/mqtt-plumber/mqtt5"
+)
+
+// Match numeric values (int, float, etc)
+var reNumeric = regexp.MustCompile(`^[0-9\.]+$`)
+
+// Match json
+var reJSON = regexp.MustCompile(`^\{.*\}$`)
+
+// Colors
+// ------
+var (
+	ERR  = color.New(color.FgRed)
+	WARN = color.New(color.FgYellow)
+	OK   = color.New(color.FgGreen)
+	INFO = color.New(color.FgMagenta)
+)
+
+// Logger gets plumber's output a line at a time: the tag (e.g. DB, empty for
+// untagged lines), the color of its level (OK, INFO, WARN or ERR) and the
+// newline terminated text
+type Logger func(tag string, level *color.Color, text string)
+
+// StdoutLogger prints lines to stdout in color, the default
+func StdoutLogger(tag string, level *color.Color, text string) {
+	if len(tag) == 0 {
+		level.Print(text)
+		return
+	}
+	put := level.SprintFunc()
+	fmt.Printf("[%s] %s", put(tag), text)
+}
+
+// DiscardLogger drops all output
+func DiscardLogger(tag string, level *color.Color, text string) {}
+
+var (
+	loggerMu sync.RWMutex
+	logger   Logger = StdoutLogger
+)
+
+// SetLogger sets where the package logs to, for every Plumber in the process
+// (Config.Logger sets it too). Nil restores StdoutLogger.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = StdoutLogger
+	}
+	loggerMu.Lock()
+	logger = l
+	loggerMu.Unlock()
+}
+
+func status(status string, c *color.Color, out string) {
+	loggerMu.RLock()
+	l := logger
+	loggerMu.RUnlock()
+	l(status, c, out)
+}
+
+// Sink is where points are written, e.g. InfluxDB
+type Sink interface {
+	Write(series string, data map[string]interface{}, t time.Time) error
+}
+
+// Hooks are called as messages go through the pipeline, if set. They run on
+// the client's message goroutine, so should return quickly.
+type Hooks struct {
+	// Every message received, watched or not
+	Received func(broker *Broker, message MQTT.Message)
+
+	// Every point written to the sink, including $SYS metrics and rollups
+	Persisted func(series string, data map[string]interface{}, t time.Time)
+
+	// Failures writing to the sink, subscribing and publishing. Without it,
+	// they're logged.
+	Error func(err error)
+}
+
+// Config for a Plumber, one field per mqtt-plumber flag. Comma-separated
+// rule specs are as documented for the flags.
+type Config struct {
+	Broker    string // uri, or embedded:// for the embedded broker
+	Protocol  string // 3.1.1 (default) or 5
+	Brokers   string // name=uri[;option] brokers to connect to instead of Broker
+	ClientID  string
+	Watch     []string
+	Sys       bool
+	Sparkplug bool   // decode Sparkplug B (spBv1.0/#) topics
+	Publish   string // default topic for Input, {client} is the client id
+	Prefix    string
+	Qos       int
+	Clean     bool
+	Store     string
+	Listen    string // address for the embedded broker, if any
+	Group     string
+	GroupMode string // auto (default), shared or hash
+
+	Decoders         string
+	SparkplugRebirth bool // ask Sparkplug edge nodes to rebirth on unknown aliases or gaps
+	DateLayouts      string
+	Timestamps       string
+	Retained         string
+	Republish        string
+	Rollups          string
+	RollupGrace      time.Duration
+	Alerts           string
+	AlertTopic       string
+	AlertWebhook     string
+	Geofences        string
+	GeofenceTopic    string
+	Webhooks         string
+	WebhookSpool     string
+	Dedup            string
+	DedupWindow      time.Duration // required with Dedup
+	DedupSize        int           // required with Dedup
+	CacheSize        int           // last values to keep, 0 disables the cache
+	QueryMaxRange    time.Duration // longest time range a query or track can cover
+	QueryLimit       int           // most rows a query or track returns, 0 disables both
+
+	HTTP      string // address for the HTTP API, if any
+	Bridge    string // remote broker uri, if any
+	BridgeOut string
+	BridgeIn  string
+	Record    string // capture file to record to, if any
+
+	Verbose bool
+
+	// Where output goes, for the whole process (see SetLogger). Nil keeps the
+	// current logger, StdoutLogger unless set.
+	Logger Logger
+
+	// Connects to a broker, the default is paho or the mqtt5 client per
+	// protocol. Set it to use another client, or a fake in tests.
+	Dial func(protocol string, opts *ClientOptions) (Client, error)
+}
+
+// Plumber is a running pipeline, from broker subscriptions to the sink
+type Plumber struct {
+	Hooks Hooks
+
+	config  Config
+	sink    Sink
+	brokers []*Broker // the first is used for the prompt, alerts and replay
+	mqtt    Client    // client of the first broker
+
+	// Per-topic rules
+	decoderRules    Rules
+	timestampRules  Rules
+	dateLayoutRules Rules
+	republishRules  Rules
+	retainedRules   Rules
+	bridgeOut       Rules
+	bridgeIn        Rules
+
+	lastValues  *LastValueCache // nil when disabled
+	rollups     *Rollups        // nil when disabled
+	alerts      *Alerts         // nil when disabled
+	geofences   *Geofences      // nil when disabled
+	webhooks    *Webhooks       // nil when disabled
+	dedup       *Deduplicator   // nil when disabled
+	server      *Server         // embedded broker, nil when disabled
+	recorder    *Recorder       // nil when disabled
+	bridge      *Bridge         // nil when disabled
+	api         *http.Server    // nil when disabled
+	sysCounters *sysCounters
+	sparkplug   *sparkplugNodes
+
+	// Successful topic subscriptions
+	subscriptions []string
+}
+
+// New checks the config and sets up the pipeline, without connecting
+func New(config Config, sink Sink) (*Plumber, error) {
+	if config.Logger != nil {
+		SetLogger(config.Logger)
+	}
+	if len(config.Protocol) == 0 {
+		config.Protocol = Protocol311
+	}
+	if len(config.GroupMode) == 0 {
+		config.GroupMode = GroupAuto
+	}
+	if err := checkGroupMode(config.GroupMode); err != nil {
+		return nil, err
+	}
+
+	p := &Plumber{config: config, sink: sink, sysCounters: newSysCounters(), sparkplug: newSparkplugNodes()}
+
+	var err error
+	if p.decoderRules, err = ParseRules(config.Decoders, parseDecoders); err != nil {
+		return nil, err
+	}
+	if p.timestampRules, err = ParseRules(config.Timestamps, parseTimestampField); err != nil {
+		return nil, err
+	}
+	if p.dateLayoutRules, err = ParseRules(config.DateLayouts, parseDateLayouts); err != nil {
+		return nil, err
+	}
+	if p.republishRules, err = ParseRules(config.Republish, parseRepublishPrefix); err != nil {
+		return nil, err
+	}
+	if p.retainedRules, err = ParseRules(config.Retained, parseRetainedMode); err != nil {
+		return nil, err
+	}
+	if p.bridgeOut, err = ParseRules(config.BridgeOut, bridgeRouteParser(config.Prefix)); err != nil {
+		return nil, err
+	}
+	if p.bridgeIn, err = ParseRules(config.BridgeIn, bridgeRouteParser(config.Prefix)); err != nil {
+		return nil, err
+	}
+
+	rules, err := ParseRules(config.Rollups, parseRollupSpec)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) > 0 {
+		p.rollups = NewRollups(rules, p.timestampRules, config.RollupGrace, p.write, config.Verbose)
+	}
+
+	if rules, err = ParseRules(config.Alerts, parseAlertCondition); err != nil {
+		return nil, err
+	}
+	if len(rules) > 0 {
+		p.alerts = NewAlerts(rules, config.AlertTopic, config.AlertWebhook, func(topic string, payload []byte, done func(err error)) {
+			p.mqtt.Publish(topic, byte(config.Qos), false, payload, nil, done)
+		})
+	}
+
+	if rules, err = ParseRules(config.Geofences, parseGeofence); err != nil {
+		return nil, err
+	}
+	if len(rules) > 0 {
+		p.geofences = NewGeofences(rules, config.GeofenceTopic, func(topic string, payload []byte, done func(err error)) {
+			p.mqtt.Publish(topic, byte(config.Qos), true, payload, nil, done)
+		}, p.write)
+	}
+
+	if rules, err = ParseRules(config.Dedup, parseDedupField); err != nil {
+		return nil, err
+	}
+	if len(rules) > 0 {
+		// Nothing would be remembered long enough to be seen again
+		if config.DedupWindow <= 0 || config.DedupSize <= 0 {
+			return nil, fmt.Errorf("dedup needs a positive window and size, not %s and %d", config.DedupWindow, config.DedupSize)
+		}
+		p.dedup = NewDeduplicator(rules, config.DedupWindow, config.DedupSize)
+	}
+
+	if rules, err = ParseRules(config.Webhooks, parseWebhook); err != nil {
+		return nil, err
+	}
+	if len(rules) > 0 {
+		if len(config.WebhookSpool) > 0 {
+			if err := os.MkdirAll(config.WebhookSpool, 0700); err != nil {
+				return nil, err
+			}
+		}
+		p.webhooks = NewWebhooks(rules, config.WebhookSpool, config.Verbose)
+	}
+
+	if config.CacheSize > 0 {
+		p.lastValues = NewLastValueCache(config.CacheSize)
+	}
+
+	// Brokers, the config is the default for Brokers options
+	defaults := &Broker{
+		URI:       config.Broker,
+		Protocol:  config.Protocol,
+		ClientID:  config.ClientID,
+		Watch:     config.Watch,
+		Qos:       byte(config.Qos),
+		Prefix:    config.Prefix,
+		Clean:     config.Clean,
+		Sys:       config.Sys,
+		Sparkplug: config.Sparkplug,
+		Group:     config.Group,
+		GroupMode: config.GroupMode,
+	}
+	if p.brokers, err = parseBrokers(config.Brokers, defaults); err != nil {
+		return nil, err
+	}
+	if len(p.brokers) == 0 {
+		p.brokers = []*Broker{defaults}
+	}
+	for _, b := range p.brokers {
+		b.plumber = p
+	}
+
+	return p, nil
+}
+
+// Brokers the plumber connects to
+func (p *Plumber) Brokers() []*Broker {
+	return p.brokers
+}
+
+// Client of the first broker, nil until connected
+func (p *Plumber) Client() Client {
+	return p.mqtt
+}
+
+// Start the embedded broker and HTTP API (if configured), connect to every
+// broker, subscribe and start the background workers
+func (p *Plumber) Start() error {
+	if err := p.listen(); err != nil {
+		return err
+	}
+
+	if len(p.config.HTTP) > 0 {
+		if err := p.serveAPI(p.config.HTTP); err != nil {
+			return err
+		}
+	}
+	if p.rollups != nil {
+		p.rollups.Run(time.Second)
+	}
+	if p.webhooks != nil {
+		p.webhooks.Run()
+	}
+
+	for _, b := range p.brokers {
+		if err := b.Connect(p.config.Store); err != nil {
+			return err
+		}
+	}
+	p.mqtt = p.brokers[0].client
+
+	// Alerts and geofences publish through the client, so tick once it's set
+	if p.alerts != nil {
+		p.alerts.Run(time.Second)
+	}
+	if p.geofences != nil {
+		p.geofences.Run(time.Second)
+	}
+
+	if len(p.config.Record) > 0 {
+		recorder, err := NewRecorder(p.config.Record)
+		if err != nil {
+			return err
+		}
+		p.recorder = recorder
+		status("OK", OK, fmt.Sprintf("Recording to %s\n", p.config.Record))
+	}
+
+	// Create subscriptions
+	p.subscriptions = nil
+	for _, b := range p.brokers {
+		if err := b.Subscribe(); err != nil {
+			return err
+		}
+	}
+
+	// Forward between local and remote broker
+	if len(p.config.Bridge) > 0 {
+		// The bridge connects over the network, also to the embedded broker
+		local := p.brokers[0].URI
+		if strings.HasPrefix(local, embeddedScheme) && p.server != nil {
+			local = "tcp://" + p.server.Addr().String()
+		}
+		p.bridge = NewBridge(p.bridgeOut, p.bridgeIn, p.config.Verbose)
+		if err := p.bridge.Connect(local, p.config.Bridge, p.brokers[0].ClientID, p.brokers[0].Qos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop everything Start started: the HTTP API and background workers shut
+// down, scaling groups are left and clients disconnected, then rollups and
+// webhook batches are flushed and the recorder and embedded broker closed.
+// The plumber can be started again after.
+func (p *Plumber) Stop() {
+	if p.api != nil {
+		p.api.Close()
+		p.api = nil
+	}
+	if p.alerts != nil {
+		p.alerts.Stop()
+	}
+	if p.geofences != nil {
+		p.geofences.Stop()
+	}
+
+	for _, b := range p.brokers {
+		if b.client == nil {
+			continue
+		}
+		b.Leave()
+		b.client.Disconnect(250)
+		b.client = nil
+	}
+	if p.bridge != nil {
+		p.bridge.Disconnect()
+		p.bridge = nil
+	}
+
+	if p.rollups != nil {
+		p.rollups.Stop()
+	}
+	if p.webhooks != nil {
+		p.webhooks.Stop()
+	}
+	if p.recorder != nil {
+		p.recorder.Close()
+		p.recorder = nil
+	}
+	if p.server != nil {
+		p.server.Close()
+		p.server = nil
+	}
+}
+
+// Start the embedded broker, if configured and not yet running
+func (p *Plumber) listen() error {
+	if len(p.config.Listen) == 0 || p.server != nil {
+		return nil
+	}
+	server, err := Listen(p.config.Listen, p.config.Verbose)
+	if err != nil {
+		return err
+	}
+	p.server = server
+	return nil
+}
+
+// Report a failure to the error hook, or log it without one
+func (p *Plumber) fail(err error) {
+	if p.Hooks.Error == nil {
+		status("ERR", ERR, fmt.Sprintln(err))
+		return
+	}
+	p.Hooks.Error(err)
+}
+
+// Report a failure to the error hook, if any
+func (p *Plumber) report(err error) {
+	if p.Hooks.Error != nil {
+		p.Hooks.Error(err)
+	}
+}
+
+//
+// Database
+//
+
+func (p *Plumber) persist(topic string, messageTopic string, data map[string]interface{}, received time.Time) {
+	t := p.pointTime(messageTopic, data, received)
+	if p.rollups != nil {
+		p.rollups.Add(topic, messageTopic, data, t)
+	}
+
+	if p.write(topic, data, t) != nil {
+		return
+	}
+
+	status("DB", OK, fmt.Sprintf("Persisted to series %s (params %s)\n", topic, data["params"]))
+}
+
+// Write a single point to the named series, failures are reported and
+// returned
+func (p *Plumber) write(name string, data map[string]interface{}, t time.Time) error {
+	if err := p.sink.Write(name, data, t); err != nil {
+		err = fmt.Errorf("writing to series %s: %s", name, err)
+		p.fail(err)
+		return err
+	}
+
+	if p.Hooks.Persisted != nil {
+		p.Hooks.Persisted(name, data, t)
+	}
+	return nil
+}
+
+//
+// Publishing
+//
+
+// Publish from within a message handler. Waiting on the token there can
+// deadlock the client (the ack is read by the goroutine that is blocked
+// dispatching to us), so failures are reported from a goroutine instead.
+func publishAsync(client *MQTT.Client, topic string, qos byte, retained bool, payload interface{}, onDone func(err error)) {
+	token := client.Publish(topic, qos, retained, payload)
+	go func() {
+		token.Wait()
+		onDone(token.Error())
+	}()
+}
+
+// Input handles a line typed at the prompt: a `:command`, or a message to
+// publish as `[topic] payload`, to the Publish topic if left out
+func (p *Plumber) Input(in string) {
+	// Empty input
+	if len(in) == 0 {
+		return
+	}
+
+	// Prompt command, e.g. `:last owntracks/#`
+	if strings.HasPrefix(in, ":") {
+		p.onCommandReceived(strings.TrimSpace(in))
+		return
+	}
+
+	// Split input on first space: {the/pub/topic} {message payload with spaces}
+	var pubTopic, message = func(str string) (string, string) {
+		parts := strings.SplitN(str, " ", 2)
+		if len(parts) < 2 {
+			parts = []string{p.config.Publish, parts[0]}
+
+		}
+		return strings.Replace(parts[0], "{client}", p.config.ClientID, -1), parts[1]
+	}(strings.TrimSpace(in))
+
+	// Don't publish empty messages
+	if len(message) == 0 {
+		return
+	}
+
+	// Publish to MQTT
+	if p.config.Verbose {
+		status("PUB", INFO, fmt.Sprintf("Publishing to %s: %s\n", pubTopic, message))
+	}
+	if err := publishWait(p.mqtt, pubTopic, byte(p.config.Qos), false, []byte(message)); err != nil {
+		status("PUB", ERR, fmt.Sprintln("Failed to publish message", pubTopic, err))
+		return
+	}
+	status("PUB", OK, fmt.Sprintln("Message published to", pubTopic))
+}
+
+//
+// Message parsing
+//
+
+func (p *Plumber) parse(topic string, payload []byte, props *mqtt5.Properties) []byte {
+	var jsonPayload []byte
+	var matched string
+	if rule := p.decoderRules.Match(topic); rule != nil {
+		// Configured decoders, falling back to detection if none take it
+		var err error
+		if jsonPayload, matched, err = decodeChain(topic, payload, rule.Value.([]namedDecoder)); err != nil {
+			status("ERR", ERR, fmt.Sprintf("Failed to decode payload on %s: %s\n", topic, err))
+		}
+	}
+	if jsonPayload == nil {
+		jsonPayload, matched = p.detect(topic, payload, props)
+	}
+
+	if p.config.Verbose {
+		status("", INFO, fmt.Sprintf("parsed (%s) %s\n", matched, jsonPayload))
+	}
+
+	return jsonPayload
+}
+
+// Detect the payload type and wrap it as json for normalizing
+func (p *Plumber) detect(topic string, payload []byte, props *mqtt5.Properties) (jsonPayload []byte, matched string) {
+	// Unmarshal payload by parsing the string value, wrapping in json, and
+	// converting to bytes, theb using the json unmarshaler to figure out what the
+	// correct numeric value types should be
+
+	if declared := declaredType(props); len(declared) > 0 && declared != payloadText {
+		// MQTT 5 publishers can say what they sent
+		matched = declared + ", declared"
+		jsonPayload = parseDeclared(topic, payload, declared)
+	} else if binary, format, ok := detectBinary(payload); ok && declared != payloadText {
+		// MessagePack or CBOR from constrained devices
+		matched = format
+		jsonPayload = binary
+	} else if declared != payloadText && reJSON.Match(payload) {
+		matched = "json"
+		jsonPayload = payload
+	} else if date, ok, err := p.detectDate(topic, string(payload)); ok {
+		matched = "date"
+		// Reformat dates as ISO-8601 (w/o nanos)
+		jsonPayload = []byte(fmt.Sprintf("{\"value\": \"%s\"}", date.Format(time.RFC3339)))
+	} else if err != nil {
+		matched = "string"
+		// Keep the original value rather than persisting a zero time
+		status("ERR", ERR, fmt.Sprintf("Failed to parse date on %s: %s\n", topic, err))
+		jsonPayload = stringValue(payload)
+	} else if reNumeric.Match(payload) {
+		matched = "numeric"
+		// Let json unmarshaler figure out what type of numeric
+		jsonPayload = []byte(fmt.Sprintf("{\"value\": %s}", payload))
+	} else {
+		matched = "string"
+		// Quote the value as a string
+		jsonPayload = stringValue(payload)
+	}
+
+	return jsonPayload, matched
+}
+
+// Wrap a payload as a json string value, escaping quotes and the like
+func stringValue(payload []byte) []byte {
+	jsonPayload, _ := json.Marshal(map[string]string{"value": string(payload)})
+	return jsonPayload
+}
+
+// Convert a parsed payload into the normalized point for the watched topic
+func normalize(topic string, messageTopic string, payload []byte) (map[string]interface{}, error) {
+	parser := Parse(topic)
+
+	// Convert json to string:obj map
+	var data map[string]interface{}
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return nil, fmt.Errorf("bad payload on %s: %s", messageTopic, err)
+	}
+
+	// todo: (iw) parse topic wildcards into additional key/values
+	data["topic"] = messageTopic
+	data["params"] = strings.Join(parser.Params(messageTopic), ", ")
+
+	return data, nil
+}
+
+//
+// Message handlers
+//
+
+func (p *Plumber) onSysMessageReceived(broker *Broker, message MQTT.Message) {
+	if !broker.owns(message.Topic()) {
+		return
+	}
+	received := time.Now()
+	p.received(broker, message, received)
+
+	if message.Duplicate() {
+		status("SUB", WARN, fmt.Sprintf("Received duplicate message on $SYS topic: %s\n", message.Topic()))
+	} else {
+		status("SUB", INFO, fmt.Sprintf("Received message on $SYS topic: %s\n", message.Topic()))
+	}
+
+	if p.config.Verbose {
+		status("", INFO, fmt.Sprintf("%s\n\n", message.Payload()))
+	}
+
+	// Save the decoded metrics
+	mode := p.retainedMode(message)
+	if !message.Duplicate() && mode != retainedSkip && !p.isDuplicate(broker, message, nil, received) {
+		p.cacheLastValue(broker, message, p.parse(message.Topic(), message.Payload(), messageProperties(message)), received)
+		if mode != retainedCache {
+			p.persistSys(broker, message.Topic(), message.Payload(), mode == retainedPersist, received)
+		}
+	}
+}
+
+func (p *Plumber) onTopicMessageReceived(broker *Broker, message MQTT.Message, topic string) {
+	// Another instance in the group has it
+	if !broker.owns(message.Topic()) {
+		return
+	}
+	received := time.Now()
+	p.received(broker, message, received)
+
+	if message.Duplicate() {
+		status("SUB", WARN, fmt.Sprintf("Received duplicate message on watched topic: %s\n", message.Topic()))
+	} else if message.Retained() {
+		status("SUB", INFO, fmt.Sprintf("Received retained message on watched topic: %s (%s)\n", message.Topic(), p.retainedMode(message)))
+	} else {
+		status("SUB", INFO, fmt.Sprintf("Received message on watched topic: %s\n", message.Topic()))
+	}
+
+	if p.config.Verbose {
+		status("", INFO, fmt.Sprintf("%s\n\n", message.Payload()))
+	}
+
+	// Save the processed message
+	if !message.Duplicate() {
+		p.respond(broker, message, p.process(broker, topic, message, received), received)
+	}
+}
+
+// Run a message on a watched topic through the pipeline, returning what
+// became of it
+func (p *Plumber) process(broker *Broker, topic string, message MQTT.Message, received time.Time) string {
+	props := messageProperties(message)
+	value := p.parse(message.Topic(), message.Payload(), props)
+	data, err := normalize(topic, message.Topic(), value)
+	if err != nil {
+		p.fail(err)
+		return resultSkipped
+	}
+	addUserProperties(data, props)
+	broker.tag(data)
+
+	mode := p.retainedMode(message)
+	if mode == retainedSkip {
+		return resultSkipped
+	}
+	if p.isDuplicate(broker, message, data, received) {
+		return resultDuplicate
+	}
+
+	p.cacheLastValue(broker, message, value, received)
+	if mode == retainedCache {
+		return resultCached
+	}
+	if mode == retainedPersist {
+		data["retained"] = true
+	}
+
+	if p.alerts != nil {
+		p.alerts.Check(message.Topic(), data, received)
+	}
+	if p.geofences != nil {
+		p.geofences.Check(message.Topic(), data, p.pointTime(message.Topic(), data, received))
+	}
+	p.republish(broker, message.Topic(), data, received)
+	if p.webhooks != nil {
+		p.webhooks.Send(message.Topic(), data, received)
+	}
+	p.persist(topic, message.Topic(), data, received)
+	return resultPersisted
+}
+
+func (p *Plumber) onAnyMessageReceived(broker *Broker, message MQTT.Message) {
+	p.received(broker, message, time.Now())
+
+	if message.Duplicate() {
+		status("SUB", WARN, fmt.Sprintf("Received duplicate message on unwatched topic: %s\n", message.Topic()))
+	} else {
+		status("SUB", INFO, fmt.Sprintf("Received message on unwatched topic: %s\n", message.Topic()))
+	}
+
+	if p.config.Verbose {
+		status("", INFO, fmt.Sprintf("%s\n\n", message.Payload()))
+	}
+
+	// Don't persist random messages
+}
+
+// Record a received message and tell the hook
+func (p *Plumber) received(broker *Broker, message MQTT.Message, received time.Time) {
+	p.record(message, received)
+	if p.Hooks.Received != nil {
+		p.Hooks.Received(broker, message)
+	}
+}
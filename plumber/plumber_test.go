@@ -0,0 +1,358 @@
+package plumber
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"github.com/impressiver/mqtt-plumber/mqtt5"
+)
+
+// A message published through the fake client
+type testPublish struct {
+	topic   string
+	payload []byte
+}
+
+// Client recording subscriptions and publishes, messages are delivered by
+// calling the handlers
+type testClient struct {
+	sync.Mutex
+	handlers    map[string]MQTT.MessageHandler
+	published   []testPublish
+	disconnects int
+}
+
+func (c *testClient) Subscribe(filter string, qos byte, handler MQTT.MessageHandler) error {
+	c.Lock()
+	defer c.Unlock()
+	c.handlers[filter] = handler
+	return nil
+}
+
+func (c *testClient) Unsubscribe(filters ...string) error {
+	c.Lock()
+	defer c.Unlock()
+	for _, filter := range filters {
+		delete(c.handlers, filter)
+	}
+	return nil
+}
+
+func (c *testClient) Publish(topic string, qos byte, retained bool, payload []byte, props *mqtt5.Properties, done func(err error)) {
+	c.Lock()
+	c.published = append(c.published, testPublish{topic, payload})
+	c.Unlock()
+	if done != nil {
+		done(nil)
+	}
+}
+
+func (c *testClient) Disconnect(quiesce uint) {
+	c.Lock()
+	c.disconnects++
+	c.Unlock()
+}
+
+func (c *testClient) SharedSubscriptions() bool { return false }
+
+// Deliver a message to the handler subscribed to filter
+func (c *testClient) deliver(t *testing.T, filter string, message MQTT.Message) {
+	c.Lock()
+	handler := c.handlers[filter]
+	c.Unlock()
+	if handler == nil {
+		t.Fatalf("nothing subscribed to %s", filter)
+	}
+	handler(nil, message)
+}
+
+// Start a plumber on a fake client, failing the test on reported errors
+func startTestPlumber(t *testing.T, config Config, sink Sink) (*Plumber, *testClient) {
+	client := &testClient{handlers: make(map[string]MQTT.MessageHandler)}
+	config.Broker = "tcp://fake:1883"
+	config.ClientID = "plumber"
+	config.Logger = DiscardLogger
+	config.Dial = func(protocol string, opts *ClientOptions) (Client, error) {
+		return client, nil
+	}
+
+	p, err := New(config, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Hooks.Error = func(err error) { t.Error(err) }
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return p, client
+}
+
+// The sink has no more points
+func expectNoPoint(t *testing.T, sink *testSink) {
+	sink.Lock()
+	defer sink.Unlock()
+	if len(sink.points) > 0 {
+		t.Errorf("unexpected points %v", sink.points)
+	}
+}
+
+func TestProcessWatchedTopics(t *testing.T) {
+	sink := newTestSink()
+	p, client := startTestPlumber(t, Config{Watch: []string{"sensors/+/temp"}}, sink)
+	defer p.Stop()
+
+	client.deliver(t, "sensors/+/temp", &serverMessage{topic: "sensors/kitchen/temp", payload: []byte("21.5")})
+	point := sink.next(t)
+	if point.series != "sensors/+/temp" {
+		t.Errorf("series = %q, want sensors/+/temp", point.series)
+	}
+	if point.data["value"] != 21.5 || point.data["topic"] != "sensors/kitchen/temp" {
+		t.Errorf("data = %v", point.data)
+	}
+	if _, ok := point.data["retained"]; ok {
+		t.Errorf("live message flagged retained: %v", point.data)
+	}
+
+	// Retained messages are persisted with the flag
+	client.deliver(t, "sensors/+/temp", &serverMessage{topic: "sensors/hall/temp", payload: []byte(`{"value": "warm"}`), retained: true})
+	point = sink.next(t)
+	if point.data["value"] != "warm" || point.data["retained"] != true {
+		t.Errorf("data = %v", point.data)
+	}
+}
+
+func TestProcessReportsFailures(t *testing.T) {
+	sink := newTestSink()
+	p, client := startTestPlumber(t, Config{Watch: []string{"sensors/#"}}, sink)
+	defer p.Stop()
+
+	var errs []error
+	p.Hooks.Error = func(err error) { errs = append(errs, err) }
+	persisted := 0
+	p.Hooks.Persisted = func(series string, data map[string]interface{}, t time.Time) { persisted++ }
+
+	// Payloads that look like json but aren't
+	client.deliver(t, "sensors/#", &serverMessage{topic: "sensors/a", payload: []byte("{bad}")})
+	if len(errs) != 1 {
+		t.Errorf("errors = %v, want one for the payload", errs)
+	}
+
+	// Sink failures are reported, not persisted
+	sink.err = errors.New("sink down")
+	client.deliver(t, "sensors/#", &serverMessage{topic: "sensors/a", payload: []byte("1")})
+	if len(errs) != 2 {
+		t.Errorf("errors = %v, want one for the write", errs)
+	}
+	if persisted != 0 {
+		t.Errorf("%d points persisted, want none", persisted)
+	}
+
+	// Without a hook they're logged
+	p.Hooks.Error = nil
+	client.deliver(t, "sensors/#", &serverMessage{topic: "sensors/a", payload: []byte("2")})
+	expectNoPoint(t, sink)
+}
+
+func TestNewRejectsEmptyDedup(t *testing.T) {
+	for _, config := range []Config{
+		{Dedup: "sensors/#", DedupWindow: 0, DedupSize: 100},
+		{Dedup: "sensors/#", DedupWindow: time.Minute, DedupSize: 0},
+		{Dedup: "sensors/#", DedupWindow: -time.Minute, DedupSize: 100},
+	} {
+		config.Broker = "tcp://fake:1883"
+		if _, err := New(config, newTestSink()); err == nil {
+			t.Errorf("dedup window %s and size %d accepted", config.DedupWindow, config.DedupSize)
+		}
+	}
+}
+
+func TestSysMessages(t *testing.T) {
+	sink := newTestSink()
+	p, client := startTestPlumber(t, Config{Sys: true}, sink)
+	defer p.Stop()
+
+	client.deliver(t, "$SYS/#", &serverMessage{topic: "$SYS/broker/clients/connected", payload: []byte("5")})
+	point := sink.next(t)
+	if point.series != "broker.clients.connected" || point.data["value"] != 5.0 || point.data["unit"] != "clients" {
+		t.Errorf("point = %v", point)
+	}
+
+	// Counters get a rate besides their value
+	client.deliver(t, "$SYS/#", &serverMessage{topic: "$SYS/broker/bytes/received", payload: []byte("100")})
+	if point := sink.next(t); point.series != "broker.bytes.received" || point.data["value"] != 100.0 {
+		t.Errorf("point = %v", point)
+	}
+	time.Sleep(10 * time.Millisecond)
+	client.deliver(t, "$SYS/#", &serverMessage{topic: "$SYS/broker/bytes/received", payload: []byte("200")})
+	if point := sink.next(t); point.series != "broker.bytes.received" || point.data["value"] != 200.0 {
+		t.Errorf("point = %v", point)
+	}
+	point = sink.next(t)
+	if rate, _ := point.data["value"].(float64); point.series != "broker.bytes.received.rate" || rate <= 0 || point.data["unit"] != "bytes/s" {
+		t.Errorf("rate point = %v", point)
+	}
+
+	// Retained metrics are flagged
+	client.deliver(t, "$SYS/#", &serverMessage{topic: "$SYS/broker/version", payload: []byte("mosquitto 1.4"), retained: true})
+	if point := sink.next(t); point.data["value"] != "mosquitto 1.4" || point.data["retained"] != true {
+		t.Errorf("point = %v", point)
+	}
+}
+
+// Sparkplug B payload with a sequence number and metrics
+func sparkplugTestPayload(ms uint64, seq uint64, metrics ...protoEncoder) []byte {
+	payload := protoEncoder{}.varint(1, ms)
+	for _, metric := range metrics {
+		payload = payload.bytes(2, metric)
+	}
+	return payload.varint(3, seq)
+}
+
+// Double metric, by name and alias or by alias alone
+func sparkplugTestMetric(name string, alias uint64, datatype uint64, value float64) protoEncoder {
+	metric := protoEncoder{}
+	if len(name) > 0 {
+		metric = metric.bytes(1, []byte(name))
+	}
+	metric = metric.varint(2, alias)
+	if datatype != 0 {
+		metric = metric.varint(4, datatype)
+	}
+	bits := math.Float64bits(value)
+	metric = metric.uvarint(13<<3 | 1)
+	for i := uint(0); i < 8; i++ {
+		metric = append(metric, byte(bits>>(8*i)))
+	}
+	return metric
+}
+
+func TestSparkplugMessages(t *testing.T) {
+	sink := newTestSink()
+	p, client := startTestPlumber(t, Config{Sparkplug: true, SparkplugRebirth: true}, sink)
+	defer p.Stop()
+
+	filter := sparkplugNamespace + "/#"
+	birth := sparkplugTestPayload(1000, 0, sparkplugTestMetric("temp", 1, spDouble, 20))
+	client.deliver(t, filter, &serverMessage{topic: "spBv1.0/plant/NBIRTH/edge1", payload: birth})
+	point := sink.next(t)
+	if point.series != "sparkplug.plant.edge1" || point.data["temp"] != 20.0 || point.data["online"] != true {
+		t.Errorf("birth point = %v", point)
+	}
+	if point.data["type"] != "NBIRTH" || point.data["group"] != "plant" || point.data["edge"] != "edge1" {
+		t.Errorf("birth columns = %v", point.data)
+	}
+	if !point.t.Equal(time.Unix(1, 0)) {
+		t.Errorf("time = %v, want the payload timestamp", point.t)
+	}
+
+	// Data by alias, typed from the birth
+	data := sparkplugTestPayload(2000, 1, sparkplugTestMetric("", 1, 0, 21.5))
+	client.deliver(t, filter, &serverMessage{topic: "spBv1.0/plant/NDATA/edge1", payload: data})
+	if point := sink.next(t); point.data["temp"] != 21.5 || point.data["seq"] != 1.0 {
+		t.Errorf("data point = %v", point)
+	}
+
+	// An unknown alias asks the node to rebirth
+	data = sparkplugTestPayload(3000, 2, sparkplugTestMetric("", 9, 0, 1))
+	client.deliver(t, filter, &serverMessage{topic: "spBv1.0/plant/NDATA/edge1", payload: data})
+	client.Lock()
+	published := client.published
+	client.Unlock()
+	if len(published) != 1 || published[0].topic != "spBv1.0/plant/NCMD/edge1" {
+		t.Errorf("published = %v, want a rebirth request", published)
+	}
+
+	// Other topics in the namespace are skipped
+	client.deliver(t, filter, &serverMessage{topic: "spBv1.0/STATE/host", payload: []byte("ONLINE")})
+	client.deliver(t, filter, &serverMessage{topic: "spBv1.0/plant//edge1/dev", payload: data})
+	client.deliver(t, filter, &serverMessage{topic: "spBv1.0/plant/N/edge1", payload: data})
+	expectNoPoint(t, sink)
+}
+
+func TestStopAndRestart(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	hooked := make(chan string, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		hooked <- string(body)
+	}))
+	defer hook.Close()
+
+	// A free port for the HTTP API, which must be released by Stop
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	config := Config{
+		Watch:     []string{"sensors/#"},
+		HTTP:      addr,
+		Rollups:   "sensors/#=1h",
+		Alerts:    "sensors/#=absent:1h",
+		Geofences: "sensors/#=home;circle:52.0 4.0|100",
+		Webhooks:  "sensors/#=" + hook.URL + ";batch:10",
+	}
+
+	sink := newTestSink()
+	p, client := startTestPlumber(t, config, sink)
+	for run := 1; run <= 2; run++ {
+		client.deliver(t, "sensors/#", &serverMessage{topic: "sensors/a", payload: []byte("1")})
+		if point := sink.next(t); point.series != "sensors/#" {
+			t.Errorf("run %d: point = %v", run, point)
+		}
+		p.Stop()
+
+		// Open rollup windows and webhook batches are flushed
+		if point := sink.next(t); point.series != "sensors/#.rollup.1h" || point.data["count"] != 1 {
+			t.Errorf("run %d: rollup = %v", run, point)
+		}
+		select {
+		case body := <-hooked:
+			if !strings.Contains(body, `"topic":"sensors/a"`) {
+				t.Errorf("run %d: webhook body = %s", run, body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("run %d: webhook batch not sent", run)
+		}
+
+		client.Lock()
+		disconnects := client.disconnects
+		client.Unlock()
+		if disconnects != run {
+			t.Errorf("run %d: %d disconnects", run, disconnects)
+		}
+		if listener, err := net.Listen("tcp", addr); err != nil {
+			t.Errorf("run %d: HTTP API still listening: %s", run, err)
+		} else {
+			listener.Close()
+		}
+
+		if run == 1 {
+			if err := p.Start(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Background workers are gone, give the HTTP servers' a moment
+	hook.Close()
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	for i := 0; runtime.NumGoroutine() > goroutines && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("%d goroutines left running, %d before starting", n, goroutines)
+	}
+}
@@ -0,0 +1,160 @@
+package plumber
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"github.com/impressiver/mqtt-plumber/mqtt5"
+)
+
+//
+// MQTT 5 message properties
+//
+
+// Payload types a publisher can declare with content type and payload
+// format indicator
+const (
+	payloadJSON    = "json"
+	payloadText    = "text"
+	payloadBinary  = "binary"
+	payloadMsgpack = "msgpack"
+	payloadCBOR    = "cbor"
+)
+
+// MQTT 5 properties of a received message, nil on MQTT 3.1.1
+func messageProperties(message MQTT.Message) *mqtt5.Properties {
+	if m, ok := message.(*mqtt5.Message); ok {
+		return m.Properties
+	}
+	return nil
+}
+
+// The payload type the publisher declared, empty when it didn't say and the
+// payload is left to detection
+func declaredType(props *mqtt5.Properties) string {
+	if props == nil {
+		return ""
+	}
+
+	contentType := strings.ToLower(strings.TrimSpace(strings.SplitN(props.ContentType, ";", 2)[0]))
+	utf8 := props.PayloadFormat != nil && *props.PayloadFormat == mqtt5.FormatUTF8
+
+	switch {
+	case contentType == "application/json" || strings.HasSuffix(contentType, "+json"):
+		return payloadJSON
+	case contentType == "application/msgpack" || contentType == "application/x-msgpack" || contentType == "application/vnd.msgpack":
+		return payloadMsgpack
+	case contentType == "application/cbor" || strings.HasSuffix(contentType, "+cbor"):
+		return payloadCBOR
+	case strings.HasPrefix(contentType, "text/") || utf8:
+		return payloadText
+	case len(contentType) > 0:
+		return payloadBinary
+	}
+	return ""
+}
+
+// Wrap a payload of declared json, msgpack, cbor or binary type for
+// normalizing. Json that isn't an object is kept under `value`, binary (and
+// msgpack or cbor that doesn't decode) is base64 encoded.
+func parseDeclared(topic string, payload []byte, declared string) []byte {
+	if declared == payloadMsgpack || declared == payloadCBOR {
+		decode := decodeMsgpack
+		if declared == payloadCBOR {
+			decode = decodeCBOR
+		}
+		data, err := decode(topic, payload)
+		if err == nil {
+			var jsonPayload []byte
+			if jsonPayload, err = json.Marshal(data); err == nil {
+				return jsonPayload
+			}
+		}
+		status("ERR", ERR, fmt.Sprintf("Invalid %s payload on %s: %s\n", declared, topic, err))
+		declared = payloadBinary
+	}
+
+	if declared == payloadBinary {
+		jsonPayload, _ := json.Marshal(map[string][]byte{"value": payload})
+		return jsonPayload
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		status("ERR", ERR, fmt.Sprintf("Invalid json payload on %s: %s\n", topic, err))
+		return stringValue(payload)
+	}
+	if _, ok := value.(map[string]interface{}); ok {
+		return payload
+	}
+	return []byte(fmt.Sprintf("{\"value\": %s}", payload))
+}
+
+// Add the message's user properties to the point, one column per key.
+// Repeated keys are joined like topic params, and payload fields win.
+func addUserProperties(data map[string]interface{}, props *mqtt5.Properties) {
+	if props == nil {
+		return
+	}
+	for _, prop := range props.User {
+		if _, ok := data[prop.Key]; ok {
+			continue
+		}
+		data[prop.Key] = strings.Join(props.Get(prop.Key), ", ")
+	}
+}
+
+// When the message expires, per its message expiry interval, or nil
+func messageExpires(message MQTT.Message, received time.Time) *time.Time {
+	props := messageProperties(message)
+	if props == nil || props.MessageExpiry == nil {
+		return nil
+	}
+	expires := received.Add(time.Duration(*props.MessageExpiry) * time.Second)
+	return &expires
+}
+
+// What became of a message on a watched topic
+const (
+	resultPersisted = "persisted"
+	resultCached    = "cached"
+	resultSkipped   = "skipped"
+	resultDuplicate = "duplicate"
+)
+
+// Response to a request, i.e. a message with a response topic
+type Response struct {
+	Topic    string    `json:"topic"`
+	Result   string    `json:"result"`
+	Received time.Time `json:"received"`
+}
+
+// Answer a message that carries a response topic with what became of it,
+// echoing its correlation data
+func (p *Plumber) respond(broker *Broker, message MQTT.Message, result string, received time.Time) {
+	props := messageProperties(message)
+	if props == nil || len(props.ResponseTopic) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(&Response{Topic: message.Topic(), Result: result, Received: received})
+	if err != nil {
+		status("PUB", ERR, fmt.Sprintln("Failed to encode response", message.Topic(), err))
+		return
+	}
+
+	responseProps := &mqtt5.Properties{
+		ContentType:     "application/json",
+		CorrelationData: props.CorrelationData,
+	}
+	broker.client.Publish(props.ResponseTopic, broker.Qos, false, payload, responseProps, func(err error) {
+		if err != nil {
+			status("PUB", ERR, fmt.Sprintln("Failed to respond to", message.Topic(), "on", props.ResponseTopic, err))
+		} else if p.config.Verbose {
+			status("PUB", OK, fmt.Sprintf("Responded to %s on %s (%s)\n", message.Topic(), props.ResponseTopic, result))
+		}
+	})
+}
@@ -0,0 +1,612 @@
+package plumber
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+	"sync"
+)
+
+//
+// Protobuf
+//
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireStart   = 3
+	wireEnd     = 4
+	wireFixed32 = 5
+)
+
+// Field types of google/protobuf/descriptor.proto
+const (
+	protoDouble   = 1
+	protoFloat    = 2
+	protoInt64    = 3
+	protoUint64   = 4
+	protoInt32    = 5
+	protoFixed64  = 6
+	protoFixed32  = 7
+	protoBool     = 8
+	protoString   = 9
+	protoGroup    = 10
+	protoMessage  = 11
+	protoBytes    = 12
+	protoUint32   = 13
+	protoEnum     = 14
+	protoSfixed32 = 15
+	protoSfixed64 = 16
+	protoSint32   = 17
+	protoSint64   = 18
+)
+
+// Message and enum types of a compiled descriptor set (protoc
+// --descriptor_set_out), by full name without the leading dot
+type protoTypes struct {
+	messages map[string]*protoMessageType
+	enums    map[string]map[int32]string
+}
+
+type protoMessageType struct {
+	name     string
+	fields   map[uint64]*protoField
+	proto3   bool
+	mapEntry bool
+}
+
+type protoField struct {
+	name     string
+	typ      uint64
+	typeName string
+	repeated bool
+	explicit bool // oneof members and proto3 optionals have no implicit default
+	message  *protoMessageType
+	enum     map[int32]string
+}
+
+// Descriptor sets by path, loaded once for every rule that names them
+var protoTypeSets = struct {
+	sync.Mutex
+	sets map[string]*protoTypes
+}{sets: make(map[string]*protoTypes)}
+
+// Parse a protobuf decoder argument, `descriptor-set-path;message.Type`
+func newProtobufDecoder(arg string) (Decoder, error) {
+	parts := strings.SplitN(arg, ";", 2)
+	if len(parts) < 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return nil, fmt.Errorf("protobuf decoder wants descriptor-set-path;message.Type, got %q", arg)
+	}
+
+	types, err := loadProtoTypes(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimPrefix(parts[1], ".")
+	message, ok := types.messages[name]
+	if !ok {
+		return nil, fmt.Errorf("no message type %s in %s", name, parts[0])
+	}
+
+	return DecoderFunc(func(topic string, payload []byte) (map[string]interface{}, error) {
+		data := make(map[string]interface{})
+		if err := message.decode(payload, "", data, 0); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}), nil
+}
+
+func loadProtoTypes(path string) (*protoTypes, error) {
+	protoTypeSets.Lock()
+	defer protoTypeSets.Unlock()
+
+	if types, ok := protoTypeSets.sets[path]; ok {
+		return types, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	types, err := parseDescriptorSet(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set %s: %s", path, err)
+	}
+	protoTypeSets.sets[path] = types
+	return types, nil
+}
+
+//
+// Wire format
+//
+
+func (r *binaryReader) varint() (uint64, error) {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("varint overflow")
+}
+
+// A little-endian fixed width value of n bytes
+func (r *binaryReader) fixed(n uint64) (uint64, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+// Read the value of a field with the given wire type, the number for
+// varint and fixed types and the bytes for length delimited ones
+func (r *binaryReader) protoValue(wire byte) (v uint64, data []byte, err error) {
+	switch wire {
+	case wireVarint:
+		v, err = r.varint()
+	case wireFixed64:
+		v, err = r.fixed(8)
+	case wireFixed32:
+		v, err = r.fixed(4)
+	case wireBytes:
+		var n uint64
+		if n, err = r.varint(); err == nil {
+			data, err = r.next(n)
+		}
+	default:
+		err = fmt.Errorf("invalid wire type %d", wire)
+	}
+	return v, data, err
+}
+
+// Skip a (deprecated) group up to its end tag
+func (r *binaryReader) skipGroup(number uint64) error {
+	if r.depth >= maxBinaryDepth {
+		return fmt.Errorf("nested too deep")
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+
+	for {
+		key, err := r.varint()
+		if err != nil {
+			return err
+		}
+		switch wire := byte(key & 7); wire {
+		case wireStart:
+			err = r.skipGroup(key >> 3)
+		case wireEnd:
+			if key>>3 != number {
+				return fmt.Errorf("mismatched group end %d", key>>3)
+			}
+			return nil
+		default:
+			_, _, err = r.protoValue(wire)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Hand each field of a protobuf message to fn, with its number, wire type and
+// value. Groups are skipped.
+func protoFields(b []byte, fn func(number uint64, wire byte, v uint64, data []byte) error) error {
+	r := &binaryReader{b: b}
+	for len(r.b) > 0 {
+		key, err := r.varint()
+		if err != nil {
+			return err
+		}
+		number, wire := key>>3, byte(key&7)
+		if number == 0 {
+			return fmt.Errorf("invalid field number 0")
+		}
+
+		if wire == wireStart {
+			if err := r.skipGroup(number); err != nil {
+				return err
+			}
+			continue
+		}
+		v, data, err := r.protoValue(wire)
+		if err != nil {
+			return err
+		}
+		if err := fn(number, wire, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Descriptors
+//
+
+// Parse a serialized google.protobuf.FileDescriptorSet
+func parseDescriptorSet(b []byte) (*protoTypes, error) {
+	types := &protoTypes{
+		messages: make(map[string]*protoMessageType),
+		enums:    make(map[string]map[int32]string),
+	}
+
+	var fields []*protoField
+	err := protoFields(b, func(number uint64, wire byte, v uint64, data []byte) error {
+		if number != 1 || wire != wireBytes {
+			return nil
+		}
+
+		// FileDescriptorProto
+		var pkg string
+		var proto3 bool
+		var messages, enums [][]byte
+		err := protoFields(data, func(number uint64, wire byte, v uint64, data []byte) error {
+			switch {
+			case wire != wireBytes:
+			case number == 2:
+				pkg = string(data)
+			case number == 4:
+				messages = append(messages, data)
+			case number == 5:
+				enums = append(enums, data)
+			case number == 12:
+				proto3 = string(data) == "proto3"
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		scope := pkg
+		if len(scope) > 0 {
+			scope += "."
+		}
+		for _, enum := range enums {
+			if err := types.addEnum(enum, scope); err != nil {
+				return err
+			}
+		}
+		for _, message := range messages {
+			added, err := types.addMessage(message, scope, proto3)
+			if err != nil {
+				return err
+			}
+			fields = append(fields, added...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve field types now every file is in
+	for _, field := range fields {
+		name := strings.TrimPrefix(field.typeName, ".")
+		switch field.typ {
+		case protoMessage:
+			if field.message = types.messages[name]; field.message == nil {
+				return nil, fmt.Errorf("unknown message type %s of field %s", name, field.name)
+			}
+		case protoEnum:
+			if field.enum = types.enums[name]; field.enum == nil {
+				return nil, fmt.Errorf("unknown enum type %s of field %s", name, field.name)
+			}
+		}
+	}
+
+	if len(types.messages) == 0 {
+		return nil, fmt.Errorf("no message types")
+	}
+	return types, nil
+}
+
+// Add a DescriptorProto and its nested types under scope, returning the
+// fields to resolve
+func (types *protoTypes) addMessage(b []byte, scope string, proto3 bool) ([]*protoField, error) {
+	message := &protoMessageType{fields: make(map[uint64]*protoField), proto3: proto3}
+	var nested, enums [][]byte
+	var fields []*protoField
+	err := protoFields(b, func(number uint64, wire byte, v uint64, data []byte) error {
+		if wire != wireBytes {
+			return nil
+		}
+		switch number {
+		case 1:
+			message.name = scope + string(data)
+		case 2:
+			field, err := parseFieldDescriptor(data)
+			if err != nil {
+				return err
+			}
+			message.fields[field.number] = field.protoField
+			fields = append(fields, field.protoField)
+		case 3:
+			nested = append(nested, data)
+		case 4:
+			enums = append(enums, data)
+		case 7:
+			// MessageOptions.map_entry
+			return protoFields(data, func(number uint64, wire byte, v uint64, data []byte) error {
+				if number == 7 && wire == wireVarint {
+					message.mapEntry = v != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(message.name) == len(scope) {
+		return nil, fmt.Errorf("unnamed message type in %q", scope)
+	}
+	types.messages[message.name] = message
+
+	for _, enum := range enums {
+		if err := types.addEnum(enum, message.name+"."); err != nil {
+			return nil, err
+		}
+	}
+	for _, b := range nested {
+		added, err := types.addMessage(b, message.name+".", proto3)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, added...)
+	}
+	return fields, nil
+}
+
+type numberedField struct {
+	number uint64
+	*protoField
+}
+
+// Parse a FieldDescriptorProto
+func parseFieldDescriptor(b []byte) (numberedField, error) {
+	field := numberedField{protoField: &protoField{}}
+	err := protoFields(b, func(number uint64, wire byte, v uint64, data []byte) error {
+		switch number {
+		case 1:
+			field.name = string(data)
+		case 3:
+			field.number = v
+		case 4:
+			field.repeated = v == 3
+		case 5:
+			field.typ = v
+		case 6:
+			field.typeName = string(data)
+		case 9, 17:
+			// oneof_index, proto3_optional
+			field.explicit = true
+		}
+		return nil
+	})
+	if err == nil && (len(field.name) == 0 || field.number == 0) {
+		err = fmt.Errorf("field without a name or number")
+	}
+	return field, err
+}
+
+// Add an EnumDescriptorProto under scope
+func (types *protoTypes) addEnum(b []byte, scope string) error {
+	var name string
+	values := make(map[int32]string)
+	err := protoFields(b, func(number uint64, wire byte, v uint64, data []byte) error {
+		switch {
+		case wire != wireBytes:
+		case number == 1:
+			name = string(data)
+		case number == 2:
+			// EnumValueDescriptorProto
+			var valueName string
+			var valueNumber int32
+			err := protoFields(data, func(number uint64, wire byte, v uint64, data []byte) error {
+				switch number {
+				case 1:
+					valueName = string(data)
+				case 2:
+					valueNumber = int32(v)
+				}
+				return nil
+			})
+			if _, ok := values[valueNumber]; !ok {
+				// First name wins for aliases
+				values[valueNumber] = valueName
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	types.enums[scope+name] = values
+	return nil
+}
+
+//
+// Messages
+//
+
+// Decode a message into data, nested messages flattened under their field
+// name, e.g. `position.lat`. Repeated fields are arrays, repeated messages
+// arrays of objects, and maps flattened by key. Enums are named.
+func (m *protoMessageType) decode(b []byte, prefix string, data map[string]interface{}, depth int) error {
+	if depth >= maxBinaryDepth {
+		return fmt.Errorf("nested too deep")
+	}
+
+	err := protoFields(b, func(number uint64, wire byte, v uint64, bytes []byte) error {
+		field, ok := m.fields[number]
+		if !ok {
+			// Unknown fields are skipped
+			return nil
+		}
+		key := prefix + field.name
+
+		if field.typ == protoMessage {
+			if wire != wireBytes {
+				return fmt.Errorf("wrong wire type %d for %s", wire, key)
+			}
+			return field.decodeMessage(bytes, key, data, depth)
+		}
+
+		values, err := field.scalars(wire, v, bytes)
+		if err != nil {
+			return fmt.Errorf("%s for %s", err, key)
+		}
+		if !field.repeated {
+			// Last one wins
+			data[key] = values[len(values)-1]
+			return nil
+		}
+		list, _ := data[key].([]interface{})
+		data[key] = append(list, values...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Zero values aren't sent for fields without presence
+	if m.proto3 || m.mapEntry {
+		for _, field := range m.fields {
+			key := prefix + field.name
+			if _, ok := data[key]; !ok && !field.repeated && !field.explicit && field.typ != protoMessage {
+				data[key] = field.zero()
+			}
+		}
+	}
+	return nil
+}
+
+func (field *protoField) decodeMessage(b []byte, key string, data map[string]interface{}, depth int) error {
+	switch {
+	case field.message.mapEntry:
+		entry := make(map[string]interface{})
+		if err := field.message.decode(b, "", entry, depth+1); err != nil {
+			return err
+		}
+		prefix := key + "." + mapKey(entry["key"])
+		delete(entry, "key")
+		for name, value := range entry {
+			// `value`, or `value.field` for message values
+			data[prefix+strings.TrimPrefix(name, "value")] = value
+		}
+		return nil
+	case field.repeated:
+		item := make(map[string]interface{})
+		if err := field.message.decode(b, "", item, depth+1); err != nil {
+			return err
+		}
+		list, _ := data[key].([]interface{})
+		data[key] = append(list, item)
+		return nil
+	}
+	// Repeats of a singular message merge
+	return field.message.decode(b, key+".", data, depth+1)
+}
+
+// Wire type a field's values are encoded with
+func (field *protoField) wire() byte {
+	switch field.typ {
+	case protoDouble, protoFixed64, protoSfixed64:
+		return wireFixed64
+	case protoFloat, protoFixed32, protoSfixed32:
+		return wireFixed32
+	case protoString, protoBytes, protoMessage:
+		return wireBytes
+	}
+	return wireVarint
+}
+
+// Values of a scalar field, several for packed repeated ones
+func (field *protoField) scalars(wire byte, v uint64, bytes []byte) ([]interface{}, error) {
+	want := field.wire()
+	if wire == want {
+		return []interface{}{field.scalar(v, bytes)}, nil
+	}
+	if wire != wireBytes || !field.repeated {
+		return nil, fmt.Errorf("wrong wire type %d", wire)
+	}
+
+	// Packed
+	var values []interface{}
+	r := &binaryReader{b: bytes}
+	for len(r.b) > 0 {
+		v, _, err := r.protoValue(want)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, field.scalar(v, nil))
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("empty packed field")
+	}
+	return values, nil
+}
+
+// A scalar as json would have it: numbers are float64, bytes base64 encoded
+// and enums their value's name (or number if it has none)
+func (field *protoField) scalar(v uint64, bytes []byte) interface{} {
+	switch field.typ {
+	case protoDouble:
+		return finite(math.Float64frombits(v))
+	case protoFloat:
+		return finite(float64(math.Float32frombits(uint32(v))))
+	case protoInt64, protoSfixed64:
+		return float64(int64(v))
+	case protoInt32, protoSfixed32:
+		return float64(int32(v))
+	case protoUint32, protoFixed32:
+		return float64(uint32(v))
+	case protoSint32:
+		return float64(int32(uint32(v)>>1) ^ -int32(v&1))
+	case protoSint64:
+		return float64(int64(v>>1) ^ -int64(v&1))
+	case protoBool:
+		return v != 0
+	case protoString:
+		return string(bytes)
+	case protoBytes:
+		return base64.StdEncoding.EncodeToString(bytes)
+	case protoEnum:
+		if name, ok := field.enum[int32(v)]; ok {
+			return name
+		}
+		return float64(int32(v))
+	}
+	// Uint64, fixed64
+	return float64(v)
+}
+
+// Value of a field that wasn't sent
+func (field *protoField) zero() interface{} {
+	switch field.typ {
+	case protoBool:
+		return false
+	case protoString, protoBytes:
+		return ""
+	}
+	return field.scalar(0, nil)
+}
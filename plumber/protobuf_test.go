@@ -0,0 +1,212 @@
+package plumber
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// FieldDescriptorProto, label 3 is repeated
+func protoTestField(name string, number, label, typ uint64, typeName string) protoEncoder {
+	field := protoEncoder{}.bytes(1, []byte(name)).varint(3, number).varint(4, label).varint(5, typ)
+	if len(typeName) > 0 {
+		field = field.bytes(6, []byte(typeName))
+	}
+	return field
+}
+
+// DescriptorProto of fields and nested types
+func protoTestMessage(name string, fields []protoEncoder, nested ...protoEncoder) protoEncoder {
+	message := protoEncoder{}.bytes(1, []byte(name))
+	for _, field := range fields {
+		message = message.bytes(2, field)
+	}
+	for _, n := range nested {
+		message = message.bytes(3, n)
+	}
+	return message
+}
+
+// Descriptor set of a proto3 file in package demo, and a proto2 one without a
+// package using its enum
+func protoTestDescriptorSet() []byte {
+	status := protoEncoder{}.bytes(1, []byte("Status"))
+	for i, name := range []string{"UNKNOWN", "OK", "FAULT"} {
+		status = status.bytes(2, protoEncoder{}.bytes(1, []byte(name)).varint(2, uint64(i)))
+	}
+
+	position := protoTestMessage("Position", []protoEncoder{
+		protoTestField("lat", 1, 1, protoDouble, ""),
+		protoTestField("lon", 2, 1, protoDouble, ""),
+	})
+	temps := protoTestMessage("TempsEntry", []protoEncoder{
+		protoTestField("key", 1, 1, protoString, ""),
+		protoTestField("value", 2, 1, protoDouble, ""),
+	}).bytes(7, protoEncoder{}.varint(7, 1))
+	reading := protoTestMessage("Reading", []protoEncoder{
+		protoTestField("a", 1, 1, protoInt32, ""),
+		protoTestField("name", 2, 1, protoString, ""),
+		protoTestField("position", 3, 1, protoMessage, ".demo.Position"),
+		protoTestField("samples", 4, 3, protoInt32, ""),
+		protoTestField("status", 5, 1, protoEnum, ".demo.Status"),
+		protoTestField("delta", 6, 1, protoSint32, ""),
+		protoTestField("on", 7, 1, protoBool, ""),
+		protoTestField("raw", 8, 1, protoBytes, ""),
+		protoTestField("path", 9, 3, protoMessage, ".demo.Position"),
+		protoTestField("temps", 10, 3, protoMessage, ".demo.Reading.TempsEntry"),
+		protoTestField("opt", 11, 1, protoInt32, "").varint(17, 1),
+		protoTestField("ratio", 12, 1, protoFloat, ""),
+		protoTestField("big", 13, 1, protoInt64, ""),
+		protoTestField("tags", 14, 3, protoString, ""),
+	}, temps)
+	node := protoTestMessage("Node", []protoEncoder{
+		protoTestField("child", 1, 1, protoMessage, ".demo.Node"),
+	})
+
+	demo := protoEncoder{}.bytes(1, []byte("demo.proto")).bytes(2, []byte("demo")).
+		bytes(4, position).bytes(4, reading).bytes(4, node).bytes(5, status).bytes(12, []byte("proto3"))
+	legacy := protoEncoder{}.bytes(1, []byte("legacy.proto")).bytes(4, protoTestMessage("Legacy", []protoEncoder{
+		protoTestField("x", 1, 1, protoInt32, ""),
+		protoTestField("s", 2, 1, protoEnum, ".demo.Status"),
+	}))
+	return protoEncoder{}.bytes(1, demo).bytes(1, legacy)
+}
+
+// Write a descriptor set to a temporary file, for the caller to remove
+func protoTestFile(t *testing.T, descriptors []byte) string {
+	file, err := ioutil.TempFile("", "descriptors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(descriptors); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+// Decoder for a message type of a descriptor set file
+func protoTestDecoder(t *testing.T, path string, message string) Decoder {
+	d, err := newProtobufDecoder(path + ";" + message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestProtobufDecode(t *testing.T) {
+	path := protoTestFile(t, protoTestDescriptorSet())
+	defer os.Remove(path)
+	reading := protoTestDecoder(t, path, "demo.Reading")
+	legacy := protoTestDecoder(t, path, ".Legacy")
+
+	for _, test := range []struct {
+		decoder Decoder
+		payload string
+		want    map[string]interface{}
+	}{
+		{reading, strings.Join([]string{
+			"08 96 01",                   // a
+			"12 07 74 65 73 74 69 6e 67", // name
+			"1a 12 09 00 00 00 00 00 40 4a 40 11 00 00 00 00 00 00 11 40", // position
+			"22 06 03 8e 02 9e a7 05",                                     // packed samples
+			"28 02",                                                       // status
+			"30 03",                                                       // delta, zigzag
+			"42 03 01 02 03",                                              // raw
+			"4a 09 09 00 00 00 00 00 00 f0 3f",                            // path
+			"4a 09 11 00 00 00 00 00 00 00 40",
+			"52 0e 0a 03 6f 75 74 11 00 00 00 00 00 00 0c c0", // temps
+			"68 ff ff ff ff ff ff ff ff ff 01",                // big
+			"72 01 61 72 01 62",                               // unpacked tags
+			"78 01",                                           // unknown field
+			"a3 01 08 01 a4 01",                               // group
+		}, " "), map[string]interface{}{
+			"a":            150.0,
+			"name":         "testing",
+			"position.lat": 52.5,
+			"position.lon": 4.25,
+			"samples":      []interface{}{3.0, 270.0, 86942.0},
+			"status":       "FAULT",
+			"delta":        -2.0,
+			"on":           false,
+			"raw":          "AQID",
+			"path":         []interface{}{map[string]interface{}{"lat": 1.0, "lon": 0.0}, map[string]interface{}{"lat": 0.0, "lon": 2.0}},
+			"temps.out":    -3.5,
+			"ratio":        0.0,
+			"big":          -1.0,
+			"tags":         []interface{}{"a", "b"},
+		}},
+
+		// Proto3 defaults, but not for optionals, repeated fields or messages
+		{reading, "", map[string]interface{}{
+			"a": 0.0, "name": "", "status": "UNKNOWN", "delta": 0.0, "on": false, "raw": "", "ratio": 0.0, "big": 0.0,
+		}},
+		{reading, "28 07 58 00", map[string]interface{}{
+			"a": 0.0, "name": "", "status": 7.0, "delta": 0.0, "on": false, "raw": "", "ratio": 0.0, "big": 0.0, "opt": 0.0,
+		}},
+
+		// Proto2 has no defaults, enums resolve across files
+		{legacy, "", map[string]interface{}{}},
+		{legacy, "08 01 10 01", map[string]interface{}{"x": 1.0, "s": "OK"}},
+	} {
+		data, err := decodeHex(t, test.decoder.Decode, test.payload)
+		if err != nil {
+			t.Errorf("%s: %s", test.payload, err)
+			continue
+		}
+		if !reflect.DeepEqual(data, test.want) {
+			t.Errorf("%s = %#v, want %#v", test.payload, data, test.want)
+		}
+	}
+}
+
+func TestProtobufInvalid(t *testing.T) {
+	path := protoTestFile(t, protoTestDescriptorSet())
+	defer os.Remove(path)
+	reading := protoTestDecoder(t, path, "demo.Reading")
+	for _, payload := range []string{
+		"12 07 74 65",                         // truncated string
+		"08 96",                               // truncated varint
+		"08 ff ff ff ff ff ff ff ff ff ff 01", // varint overflow
+		"0d 00 00 00 00",                      // fixed32 for int32
+		"1a 01",                               // message longer than the payload
+		"22 00",                               // empty packed field
+		"00 00",                               // field number 0
+		"0e",                                  // invalid wire type
+		"a3 01 08 01 ac 01",                   // mismatched group end
+		"a3 01 08 01",                         // unterminated group
+	} {
+		if data, err := decodeHex(t, reading.Decode, payload); err == nil {
+			t.Errorf("%q decoded as %v", payload, data)
+		}
+	}
+
+	// Self nesting messages are cut off
+	node := protoTestDecoder(t, path, "demo.Node")
+	nested := func(n int) []byte {
+		payload := []byte{}
+		for i := 0; i < n; i++ {
+			payload = protoEncoder{}.bytes(1, payload)
+		}
+		return payload
+	}
+	if _, err := node.Decode("nodes/a", nested(10)); err != nil {
+		t.Error(err)
+	}
+	if data, err := node.Decode("nodes/a", nested(100)); err == nil {
+		t.Errorf("100 deep decoded as %v", data)
+	}
+
+	// Bad descriptor sets and types
+	broken := protoTestFile(t, protoEncoder{}.bytes(1, protoEncoder{}.bytes(4, protoTestMessage("Broken", []protoEncoder{
+		protoTestField("missing", 1, 1, protoMessage, ".Missing"),
+	}))))
+	defer os.Remove(broken)
+	for _, arg := range []string{broken + ";Broken", path + ";demo.Missing", "/nonexistent;demo.Reading", path} {
+		if _, err := newProtobufDecoder(arg); err == nil {
+			t.Errorf("decoder %q accepted", arg)
+		}
+	}
+}
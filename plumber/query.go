@@ -0,0 +1,502 @@
+package plumber
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdb/influxdb/influxql"
+)
+
+//
+// Queries
+//
+
+// Defaults for the time range and rows a query can cover
+const (
+	DefaultQueryMaxRange = 7 * 24 * time.Hour
+	DefaultQueryLimit    = 10000
+)
+
+// What queries and track reads get with a query limit of 0
+var errQueriesDisabled = fmt.Errorf("queries are disabled")
+
+// Series name prefixes plumber writes besides watched topics
+var managedSeriesPrefixes = []string{sysSeriesPrefix, sparkplugSeriesPrefix, geofenceSeriesPrefix}
+
+// QuerySeries is a series in query results
+type QuerySeries struct {
+	Name    string          `json:"name"`
+	Columns []string        `json:"columns"`
+	Values  [][]interface{} `json:"values"`
+}
+
+// QueryResult is what a query returned, with the query as it was run
+type QueryResult struct {
+	Query     string         `json:"query"`
+	Series    []*QuerySeries `json:"series"`
+	Truncated bool           `json:"truncated,omitempty"` // more rows than the limit
+}
+
+// Querier is a Sink that can run InfluxDB 0.8 queries
+type Querier interface {
+	Query(query string) ([]*QuerySeries, error)
+}
+
+// Query runs a single SELECT or SHOW MEASUREMENTS statement (InfluxQL) on
+// plumber's series, within the configured time range and row limit. It runs
+// as the InfluxDB 0.8 query the sink speaks.
+func (p *Plumber) Query(query string) (*QueryResult, error) {
+	statement, rendered, err := p.checkQuery(query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return p.runQuery(statement, rendered)
+}
+
+// Parse a query, rejecting anything but a SELECT or SHOW MEASUREMENTS
+// statement on plumber's series, rewrite it to stay within the time range and
+// row limit, and render it for InfluxDB 0.8
+func (p *Plumber) checkQuery(query string, now time.Time) (influxql.Statement, string, error) {
+	if p.config.QueryLimit <= 0 {
+		return nil, "", errQueriesDisabled
+	}
+
+	q, err := influxql.NewParser(strings.NewReader(query)).ParseQuery()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(q.Statements) != 1 {
+		return nil, "", fmt.Errorf("want a single statement, got %d", len(q.Statements))
+	}
+
+	switch statement := q.Statements[0].(type) {
+	case *influxql.SelectStatement:
+		if statement.Target != nil {
+			return nil, "", fmt.Errorf("SELECT INTO is not allowed")
+		}
+		for _, source := range statement.Sources {
+			if err := p.checkSource(source); err != nil {
+				return nil, "", err
+			}
+		}
+		if err := p.limitTimeRange(statement, now); err != nil {
+			return nil, "", err
+		}
+		if statement.Limit <= 0 || statement.Limit > p.config.QueryLimit {
+			statement.Limit = p.config.QueryLimit
+		}
+	case *influxql.ShowMeasurementsStatement:
+		// 0.8 lists every series, the results are cut off at the limit
+		if statement.Limit <= 0 || statement.Limit > p.config.QueryLimit {
+			statement.Limit = p.config.QueryLimit
+		}
+	default:
+		return nil, "", fmt.Errorf("only SELECT and SHOW MEASUREMENTS are allowed")
+	}
+
+	rendered, err := renderQuery(q.Statements[0])
+	if err != nil {
+		return nil, "", err
+	}
+	return q.Statements[0], rendered, nil
+}
+
+// A source has to be one of plumber's series, by name in the default
+// database (nil is every series, for SHOW statements, which get their
+// results filtered)
+func (p *Plumber) checkSource(source influxql.Source) error {
+	if source == nil {
+		return nil
+	}
+	m, ok := source.(*influxql.Measurement)
+	if !ok {
+		return fmt.Errorf("unsupported source %s", source)
+	}
+	if m.Regex != nil || len(m.Database) > 0 || len(m.RetentionPolicy) > 0 {
+		return fmt.Errorf("source %s has to be a series name", m)
+	}
+	if !p.managedSeries(m.Name) {
+		return fmt.Errorf("%q is not a plumber series", m.Name)
+	}
+	return nil
+}
+
+// Rewrite the time condition of a SELECT to at most the max range, ending
+// at the given end or now. Unbounded starts get the whole range.
+func (p *Plumber) limitTimeRange(statement *influxql.SelectStatement, now time.Time) error {
+	maxRange := p.config.QueryMaxRange
+	if maxRange <= 0 {
+		maxRange = DefaultQueryMaxRange
+	}
+
+	var start, end time.Time
+	var rest influxql.Expr
+	if statement.Condition != nil {
+		// now() would otherwise be dropped from the condition, widening it
+		condition := influxql.Reduce(statement.Condition, &influxql.NowValuer{Now: now})
+		var err error
+		if rest, err = withoutTime(condition); err != nil {
+			return err
+		}
+		start, end = influxql.TimeRange(condition)
+	}
+
+	if end.IsZero() {
+		end = now
+	} else {
+		// The range is inclusive, the end of the condition isn't
+		end = end.Add(time.Microsecond)
+	}
+	if start.IsZero() || end.Sub(start) > maxRange {
+		start = end.Add(-maxRange)
+	}
+	if !start.Before(end) {
+		return fmt.Errorf("empty time range")
+	}
+
+	// Strict bounds, the way 0.8 takes them
+	timeRef := &influxql.VarRef{Val: "time"}
+	statement.Condition = and(and(rest,
+		&influxql.BinaryExpr{Op: influxql.GT, LHS: timeRef, RHS: &influxql.TimeLiteral{Val: start.Add(-time.Microsecond)}}),
+		&influxql.BinaryExpr{Op: influxql.LT, LHS: timeRef, RHS: &influxql.TimeLiteral{Val: end}})
+	return nil
+}
+
+// A condition without its time bounds. InfluxDB 0.8 only takes them as
+// terms of the top level AND, so time can't be anywhere else.
+func withoutTime(expr influxql.Expr) (influxql.Expr, error) {
+	switch e := expr.(type) {
+	case *influxql.ParenExpr:
+		inner, err := withoutTime(e.Expr)
+		if inner == nil || err != nil {
+			return nil, err
+		}
+		return &influxql.ParenExpr{Expr: inner}, nil
+	case *influxql.BinaryExpr:
+		if e.Op == influxql.AND {
+			lhs, err := withoutTime(e.LHS)
+			if err != nil {
+				return nil, err
+			}
+			rhs, err := withoutTime(e.RHS)
+			if err != nil {
+				return nil, err
+			}
+			return and(lhs, rhs), nil
+		}
+		if timeBound(e) {
+			return nil, nil
+		}
+	}
+
+	var mentioned bool
+	influxql.WalkFunc(expr, func(n influxql.Node) {
+		if ref, ok := n.(*influxql.VarRef); ok && strings.ToLower(ref.Val) == "time" {
+			mentioned = true
+		}
+	})
+	if mentioned {
+		return nil, fmt.Errorf("time can only be compared to a time in AND terms of the condition, not in %s", expr)
+	}
+	return expr, nil
+}
+
+// Whether an expression compares time to a time or epoch
+func timeBound(e *influxql.BinaryExpr) bool {
+	switch e.Op {
+	case influxql.EQ, influxql.LT, influxql.LTE, influxql.GT, influxql.GTE:
+	default:
+		return false
+	}
+	min, max := influxql.TimeRange(e)
+	return !min.IsZero() || !max.IsZero()
+}
+
+// Both conditions, either can be nil
+func and(lhs, rhs influxql.Expr) influxql.Expr {
+	if lhs == nil {
+		return rhs
+	}
+	if rhs == nil {
+		return lhs
+	}
+	return &influxql.BinaryExpr{Op: influxql.AND, LHS: lhs, RHS: rhs}
+}
+
+// Whether plumber writes the series: a watched topic filter, its rollups,
+// or a broker, Sparkplug or geofence series
+func (p *Plumber) managedSeries(name string) bool {
+	for _, prefix := range managedSeriesPrefixes {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return true
+		}
+	}
+	for _, b := range p.brokers {
+		for _, series := range b.watchSeries() {
+			if name == series || strings.HasPrefix(name, series+".rollup.") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Run a checked statement as rendered, dropping what the results show of
+// other series and cutting them off at the row limit (the statement's for
+// SHOW MEASUREMENTS)
+func (p *Plumber) runQuery(statement influxql.Statement, rendered string) (*QueryResult, error) {
+	querier, ok := p.sink.(Querier)
+	if !ok {
+		return nil, fmt.Errorf("the sink can't run queries")
+	}
+
+	result := &QueryResult{Query: rendered, Series: []*QuerySeries{}}
+	series, err := querier.Query(result.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := p.config.QueryLimit
+	show, isShow := statement.(*influxql.ShowMeasurementsStatement)
+	if isShow {
+		limit = show.Limit
+	}
+
+	rows := 0
+	for _, s := range series {
+		// Series are named after the series queried, except for lists of them
+		if isShow {
+			s.Values = p.managedValues(s)
+		} else if len(s.Name) > 0 && !p.managedSeries(s.Name) {
+			continue
+		}
+
+		if rows+len(s.Values) > limit {
+			result.Truncated = true
+			if s.Values = s.Values[:limit-rows]; len(s.Values) == 0 {
+				break
+			}
+		}
+		rows += len(s.Values)
+		result.Series = append(result.Series, s)
+		if result.Truncated {
+			break
+		}
+	}
+	return result, nil
+}
+
+// Rows of a measurement list that name plumber's series
+func (p *Plumber) managedValues(s *QuerySeries) [][]interface{} {
+	column := -1
+	for i, name := range s.Columns {
+		if name == "name" {
+			column = i
+		}
+	}
+
+	values := [][]interface{}{}
+	for _, row := range s.Values {
+		if column < 0 || column >= len(row) {
+			continue
+		}
+		if name, ok := row[column].(string); ok && p.managedSeries(name) {
+			values = append(values, row)
+		}
+	}
+	return values
+}
+
+//
+// InfluxDB 0.8 queries
+//
+
+// Functions InfluxDB 0.8 has
+var influx08Functions = map[string]bool{
+	"count": true, "distinct": true, "mean": true, "median": true, "mode": true,
+	"min": true, "max": true, "sum": true, "stddev": true, "percentile": true,
+	"first": true, "last": true, "derivative": true, "difference": true, "time": true,
+}
+
+// Operators as InfluxDB 0.8 writes them
+var influx08Operators = map[influxql.Token]string{
+	influxql.ADD: "+", influxql.SUB: "-", influxql.MUL: "*", influxql.DIV: "/",
+	influxql.AND: "and", influxql.OR: "or",
+	influxql.EQ: "=", influxql.NEQ: "<>", influxql.EQREGEX: "=~", influxql.NEQREGEX: "!~",
+	influxql.LT: "<", influxql.LTE: "<=", influxql.GT: ">", influxql.GTE: ">=",
+}
+
+var reInflux08Name = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Render a checked statement as the InfluxDB 0.8 query that runs it. What
+// 0.8 has no equivalent for is an error.
+func renderQuery(statement influxql.Statement) (string, error) {
+	switch s := statement.(type) {
+	case *influxql.SelectStatement:
+		return renderSelect(s)
+	case *influxql.ShowMeasurementsStatement:
+		if s.Condition != nil || len(s.SortFields) > 0 || s.Offset > 0 {
+			return "", fmt.Errorf("SHOW MEASUREMENTS can only have a LIMIT")
+		}
+		return "list series", nil
+	}
+	return "", fmt.Errorf("unsupported statement %s", statement)
+}
+
+func renderSelect(s *influxql.SelectStatement) (string, error) {
+	if len(s.Sources) != 1 {
+		return "", fmt.Errorf("want a single series, got %d", len(s.Sources))
+	}
+	if s.Offset > 0 || s.SLimit > 0 || s.SOffset > 0 {
+		return "", fmt.Errorf("OFFSET, SLIMIT and SOFFSET are not supported")
+	}
+
+	var fields []string
+	for _, field := range s.Fields {
+		expr, err := renderExpr(field.Expr)
+		if err != nil {
+			return "", err
+		}
+		if len(field.Alias) > 0 {
+			alias, err := renderName(field.Alias)
+			if err != nil {
+				return "", err
+			}
+			expr += " as " + alias
+		}
+		fields = append(fields, expr)
+	}
+	series := s.Sources[0].(*influxql.Measurement).Name
+	if strings.Contains(series, `"`) {
+		return "", fmt.Errorf("invalid series name %q", series)
+	}
+	query := fmt.Sprintf(`select %s from "%s"`, strings.Join(fields, ", "), series)
+
+	if s.Condition != nil {
+		condition, err := renderExpr(s.Condition)
+		if err != nil {
+			return "", err
+		}
+		query += " where " + condition
+	}
+
+	if len(s.Dimensions) > 0 {
+		var dimensions []string
+		for _, dimension := range s.Dimensions {
+			expr, err := renderExpr(dimension.Expr)
+			if err != nil {
+				return "", err
+			}
+			dimensions = append(dimensions, expr)
+		}
+		query += " group by " + strings.Join(dimensions, ", ")
+	}
+	switch s.Fill {
+	case influxql.NullFill:
+	case influxql.NumberFill:
+		query += fmt.Sprintf(" fill(%v)", s.FillValue)
+	default:
+		return "", fmt.Errorf("only fill(null) and fill with a number are supported")
+	}
+
+	// Oldest first unless asked otherwise, 0.8 would default to newest
+	order := "asc"
+	if len(s.SortFields) > 1 {
+		return "", fmt.Errorf("only ORDER BY time is supported")
+	} else if len(s.SortFields) == 1 {
+		if name := s.SortFields[0].Name; len(name) > 0 && name != "time" {
+			return "", fmt.Errorf("only ORDER BY time is supported")
+		}
+		if !s.SortFields[0].Ascending {
+			order = "desc"
+		}
+	}
+	return query + fmt.Sprintf(" limit %d order %s", s.Limit, order), nil
+}
+
+func renderExpr(expr influxql.Expr) (string, error) {
+	switch e := expr.(type) {
+	case *influxql.VarRef:
+		return renderName(e.Val)
+	case *influxql.Wildcard:
+		return "*", nil
+	case *influxql.NumberLiteral:
+		return strconv.FormatFloat(e.Val, 'f', -1, 64), nil
+	case *influxql.BooleanLiteral:
+		return strconv.FormatBool(e.Val), nil
+	case *influxql.StringLiteral:
+		if strings.ContainsAny(e.Val, `'\`) {
+			return "", fmt.Errorf("unsupported string %s", e)
+		}
+		return "'" + e.Val + "'", nil
+	case *influxql.TimeLiteral:
+		return fmt.Sprintf("%du", e.Val.UnixNano()/int64(time.Microsecond)), nil
+	case *influxql.DurationLiteral:
+		return renderDuration(e.Val), nil
+	case *influxql.RegexLiteral:
+		return "/" + strings.Replace(e.Val.String(), "/", `\/`, -1) + "/", nil
+	case *influxql.ParenExpr:
+		inner, err := renderExpr(e.Expr)
+		return "(" + inner + ")", err
+	case *influxql.Call:
+		if !influx08Functions[strings.ToLower(e.Name)] {
+			return "", fmt.Errorf("unsupported function %s()", e.Name)
+		}
+		var args []string
+		for _, arg := range e.Args {
+			s, err := renderExpr(arg)
+			if err != nil {
+				return "", err
+			}
+			args = append(args, s)
+		}
+		return strings.ToLower(e.Name) + "(" + strings.Join(args, ", ") + ")", nil
+	case *influxql.BinaryExpr:
+		op, ok := influx08Operators[e.Op]
+		if !ok {
+			return "", fmt.Errorf("unsupported operator %s", e.Op)
+		}
+		// Sides that bind looser than the operator go in parentheses, on the
+		// right also when the same (operators are left associative)
+		var sides [2]string
+		for i, side := range []influxql.Expr{e.LHS, e.RHS} {
+			s, err := renderExpr(side)
+			if err != nil {
+				return "", err
+			}
+			if b, ok := side.(*influxql.BinaryExpr); ok && (b.Op.Precedence() < e.Op.Precedence() || (i == 1 && b.Op.Precedence() == e.Op.Precedence())) {
+				s = "(" + s + ")"
+			}
+			sides[i] = s
+		}
+		return sides[0] + " " + op + " " + sides[1], nil
+	}
+	return "", fmt.Errorf("unsupported expression %s", expr)
+}
+
+// Column names are bare or double quoted
+func renderName(name string) (string, error) {
+	if reInflux08Name.MatchString(name) {
+		return name, nil
+	}
+	if strings.Contains(name, `"`) {
+		return "", fmt.Errorf("unsupported name %q", name)
+	}
+	return `"` + name + `"`, nil
+}
+
+// Durations in the largest unit that's exact, 0.8 has w, d, h, m, s and u
+func renderDuration(d time.Duration) string {
+	for _, unit := range []struct {
+		suffix string
+		d      time.Duration
+	}{{"w", 7 * 24 * time.Hour}, {"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}, {"s", time.Second}} {
+		if d != 0 && d%unit.d == 0 {
+			return fmt.Sprintf("%d%s", d/unit.d, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%du", d/time.Microsecond)
+}
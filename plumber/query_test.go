@@ -0,0 +1,100 @@
+package plumber
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Sink recording the queries it runs
+type testQuerySink struct {
+	testSink
+	queries []string
+	series  []*QuerySeries
+}
+
+func (s *testQuerySink) Query(query string) ([]*QuerySeries, error) {
+	s.queries = append(s.queries, query)
+	return s.series, nil
+}
+
+func TestQueryRendersInflux08(t *testing.T) {
+	sink := &testQuerySink{}
+	p, err := New(Config{
+		Broker:        "tcp://fake:1883",
+		Watch:         []string{"sensors/#"},
+		QueryMaxRange: 24 * time.Hour,
+		QueryLimit:    100,
+		Logger:        DiscardLogger,
+	}, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	us := func(t time.Time) string { return fmt.Sprintf("%du", t.UnixNano()/int64(time.Microsecond)) }
+	for query, want := range map[string]string{
+		`SELECT mean(temp) FROM "sensors/#" WHERE time > now() - 6h GROUP BY time(10m) fill(0)`: `select mean(temp) from "sensors/#" where time > ` +
+			us(now.Add(-6*time.Hour)) + ` and time < ` + us(now) + ` group by time(10m) fill(0) limit 100 order asc`,
+		`SELECT * FROM "sensors/#" WHERE topic = 'sensors/a' AND (temp > 20 OR temp < 5) ORDER BY time DESC LIMIT 5`: `select * from "sensors/#" where topic = 'sensors/a' and (temp > 20 or temp < 5) and time > ` +
+			us(now.Add(-24*time.Hour).Add(-time.Microsecond)) + ` and time < ` + us(now) + ` limit 5 order desc`,
+		`SELECT max(value) AS peak FROM "broker.clients.connected" WHERE time > '2026-09-01T00:00:00Z'`: `select max(value) as peak from "broker.clients.connected" where time > ` +
+			us(now.Add(-24*time.Hour).Add(-time.Microsecond)) + ` and time < ` + us(now) + ` limit 100 order asc`,
+		`SHOW MEASUREMENTS`: `list series`,
+	} {
+		_, rendered, err := p.checkQuery(query, now)
+		if err != nil {
+			t.Errorf("%s: %s", query, err)
+			continue
+		}
+		if rendered != want {
+			t.Errorf("%s\n got %s\nwant %s", query, rendered, want)
+		}
+	}
+
+	for _, query := range []string{
+		`SHOW SERIES`,
+		`SHOW TAG KEYS FROM "sensors/#"`,
+		`SELECT * FROM "other"`,
+		`SELECT * FROM /sensors/`,
+		`SELECT * INTO "sensors/#" FROM "sensors/#"`,
+		`SELECT * FROM "sensors/#" WHERE time > now() - 1h OR temp > 1`,
+		`SELECT * FROM "sensors/#" OFFSET 10`,
+		`SELECT * FROM "sensors/#" GROUP BY time(1m) fill(previous)`,
+		`SELECT holt_winters(temp) FROM "sensors/#"`,
+		`SELECT * FROM "sensors/#" WHERE topic = 'it''s'`,
+		`SELECT * FROM "sensors/#"; SELECT * FROM "sensors/#"`,
+	} {
+		if _, rendered, err := p.checkQuery(query, now); err == nil {
+			t.Errorf("%s allowed as %s", query, rendered)
+		}
+	}
+
+	// Lists of series are cut down to plumber's
+	statement, rendered, _ := p.checkQuery(`SHOW MEASUREMENTS`, now)
+	sink.series = []*QuerySeries{{Name: "list_series_result", Columns: []string{"time", "name"}, Values: [][]interface{}{
+		{0.0, "sensors/#"}, {0.0, "secret"}, {0.0, "broker.uptime"},
+	}}}
+	result, err := p.runQuery(statement, rendered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Series) != 1 || len(result.Series[0].Values) != 2 || result.Query != "list series" {
+		t.Errorf("result = %+v", result)
+	}
+
+	// and to their LIMIT
+	statement, rendered, _ = p.checkQuery(`SHOW MEASUREMENTS LIMIT 1`, now)
+	if result, err = p.runQuery(statement, rendered); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Series) != 1 || len(result.Series[0].Values) != 1 || !result.Truncated {
+		t.Errorf("limited result = %+v", result)
+	}
+
+	// A limit of 0 disables queries
+	p.config.QueryLimit = 0
+	if _, rendered, err := p.checkQuery(`SELECT * FROM "sensors/#"`, now); err == nil {
+		t.Errorf("query allowed as %s without a limit", rendered)
+	}
+}
@@ -0,0 +1,296 @@
+package plumber
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+)
+
+// Capture files start with this magic, followed by records of
+//
+//	uvarint receive time (unix nanos)
+//	byte    flags (qos in bits 0-1, retained in bit 2)
+//	uvarint topic length, topic
+//	uvarint payload length, payload
+const captureMagic = "PLUMBER\x01"
+
+const captureRetained = 1 << 2
+
+// Longest topic and payload MQTT can carry, anything longer in a capture is
+// corrupt
+const (
+	captureMaxTopic   = 65535
+	captureMaxPayload = 268435455
+)
+
+// Recorded is a message as kept in a capture file
+type Recorded struct {
+	Received time.Time
+	Qos      byte
+	Retained bool
+	Topic    string
+	Payload  []byte
+}
+
+// Recorder appends received messages to a capture file
+type Recorder struct {
+	sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+// Open a capture file for appending, writing the magic if it's new
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{file: file, w: bufio.NewWriter(file)}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		r.w.WriteString(captureMagic)
+		if err := r.w.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Record a message, flushing it to the file right away
+func (r *Recorder) Record(m *Recorded) error {
+	r.Lock()
+	defer r.Unlock()
+
+	var buf [binary.MaxVarintLen64]byte
+	uvarint := func(n uint64) {
+		r.w.Write(buf[:binary.PutUvarint(buf[:], n)])
+	}
+
+	flags := m.Qos & 3
+	if m.Retained {
+		flags |= captureRetained
+	}
+
+	uvarint(uint64(m.Received.UnixNano()))
+	r.w.WriteByte(flags)
+	uvarint(uint64(len(m.Topic)))
+	r.w.WriteString(m.Topic)
+	uvarint(uint64(len(m.Payload)))
+	r.w.Write(m.Payload)
+
+	return r.w.Flush()
+}
+
+func (r *Recorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.w.Flush()
+	return r.file.Close()
+}
+
+// Record a received message, if recording
+func (p *Plumber) record(message MQTT.Message, received time.Time) {
+	if p.recorder == nil {
+		return
+	}
+
+	err := p.recorder.Record(&Recorded{
+		Received: received,
+		Qos:      message.Qos(),
+		Retained: message.Retained(),
+		Topic:    message.Topic(),
+		Payload:  message.Payload(),
+	})
+	if err != nil {
+		status("REC", ERR, fmt.Sprintln("Failed to record message", message.Topic(), err))
+	}
+}
+
+// CaptureReader reads messages back from a capture file
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != captureMagic {
+		return nil, errors.New("not a plumber capture file")
+	}
+
+	return &CaptureReader{br}, nil
+}
+
+// Next returns the next message, or io.EOF at the end of the capture
+func (c *CaptureReader) Next() (*Recorded, error) {
+	received, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Anything short of a whole record is a truncated capture
+	unexpected := func(err error) error {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	flags, err := c.r.ReadByte()
+	if err != nil {
+		return nil, unexpected(err)
+	}
+
+	bytes := func(name string, max uint64) ([]byte, error) {
+		n, err := binary.ReadUvarint(c.r)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		if n > max {
+			return nil, unexpected(fmt.Errorf("corrupt capture: %s length %d is over %d", name, n, max))
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, unexpected(err)
+		}
+		return b, nil
+	}
+
+	topic, err := bytes("topic", captureMaxTopic)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := bytes("payload", captureMaxPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Recorded{
+		Received: time.Unix(0, int64(received)),
+		Qos:      flags & 3,
+		Retained: flags&captureRetained != 0,
+		Topic:    string(topic),
+		Payload:  payload,
+	}, nil
+}
+
+// Replay republishes a capture file's messages into the broker
+type Replay struct {
+	Speed   float64 // pacing multiplier, 0 is as fast as possible
+	Filters []*Parser
+	Rewrite *BridgeRoute
+	Verbose bool
+}
+
+// Replay a capture into the first broker instead of watching: connect to it
+// alone, publish the capture's messages matching the comma-separated filters
+// (default is all), rewriting their topics with the bridge route options,
+// and disconnect. Returns the number of messages published.
+func (p *Plumber) Replay(capture io.Reader, speed float64, filters string, rewrite string) (int, error) {
+	route, err := parseBridgeRoute(rewrite, p.config.Prefix)
+	if err != nil {
+		return 0, err
+	}
+	if err := p.listen(); err != nil {
+		return 0, err
+	}
+	if err := p.brokers[0].Connect(p.config.Store); err != nil {
+		return 0, err
+	}
+	p.mqtt = p.brokers[0].client
+	defer p.mqtt.Disconnect(250)
+
+	replay := &Replay{Speed: speed, Filters: parseFilters(filters), Rewrite: route.(*BridgeRoute), Verbose: p.config.Verbose}
+	return replay.Run(p.mqtt, capture)
+}
+
+// Run the replay until the end of the capture, returning the number of
+// messages published
+func (r *Replay) Run(client Client, capture io.Reader) (int, error) {
+	reader, err := NewCaptureReader(capture)
+	if err != nil {
+		return 0, err
+	}
+
+	var first time.Time
+	start := time.Now()
+	published := 0
+
+	for {
+		m, err := reader.Next()
+		if err == io.EOF {
+			return published, nil
+		}
+		if err != nil {
+			return published, err
+		}
+
+		if !r.match(m.Topic) {
+			continue
+		}
+
+		// Keep the original spacing between messages, scaled by speed
+		if r.Speed > 0 {
+			if first.IsZero() {
+				first = m.Received
+			}
+			offset := time.Duration(float64(m.Received.Sub(first)) / r.Speed)
+			if wait := offset - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		topic := m.Topic
+		if r.Rewrite != nil {
+			topic = r.Rewrite.Topic(topic)
+		}
+
+		if err := publishWait(client, topic, m.Qos, m.Retained, m.Payload); err != nil {
+			return published, err
+		}
+		published++
+
+		if r.Verbose {
+			status("PUB", OK, fmt.Sprintf("Replayed %s (recorded %s)\n", topic, m.Received.Format(time.RFC3339)))
+		}
+	}
+}
+
+func (r *Replay) match(topic string) bool {
+	if len(r.Filters) == 0 {
+		return true
+	}
+	for _, filter := range r.Filters {
+		if filter.Match(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse a comma-separated list of topic filters
+func parseFilters(list string) []*Parser {
+	var filters []*Parser
+	for _, filter := range strings.Split(list, ",") {
+		if filter = strings.TrimSpace(filter); len(filter) > 0 {
+			filters = append(filters, Parse(filter))
+		}
+	}
+	return filters
+}
@@ -0,0 +1,84 @@
+package plumber
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCaptureRoundTrip(t *testing.T) {
+	file, err := ioutil.TempFile("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	recorder, err := NewRecorder(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Recorded{Received: time.Unix(1700000000, 5), Qos: 1, Retained: true, Topic: "sensors/kitchen/temp", Payload: []byte("21.5")}
+	if err := recorder.Record(want); err != nil {
+		t.Fatal(err)
+	}
+	recorder.Close()
+
+	capture, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewCaptureReader(bytes.NewReader(capture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Received.Equal(want.Received) || m.Qos != 1 || !m.Retained || m.Topic != want.Topic || string(m.Payload) != "21.5" {
+		t.Errorf("read back %+v", m)
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("err = %v at the end, want EOF", err)
+	}
+
+	// A cut off record is unexpected
+	reader, _ = NewCaptureReader(bytes.NewReader(capture[:len(capture)-2]))
+	if _, err := reader.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("err = %v for a truncated record, want ErrUnexpectedEOF", err)
+	}
+}
+
+func TestCaptureCorruptLengths(t *testing.T) {
+	uvarint := func(b []byte, n uint64) []byte {
+		var buf [binary.MaxVarintLen64]byte
+		return append(b, buf[:binary.PutUvarint(buf[:], n)]...)
+	}
+
+	for _, lengths := range [][2]uint64{
+		{captureMaxTopic + 1, 0},
+		{1 << 62, 0},
+		{1, captureMaxPayload + 1},
+		{1, 1<<64 - 1},
+	} {
+		capture := []byte(captureMagic)
+		capture = uvarint(capture, 1)
+		capture = append(capture, 0)
+		capture = uvarint(capture, lengths[0])
+		capture = append(capture, 'a')
+		capture = uvarint(capture, lengths[1])
+
+		reader, err := NewCaptureReader(bytes.NewReader(capture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, err := reader.Next(); err == nil || err == io.ErrUnexpectedEOF {
+			t.Errorf("lengths %v: read %v, %v, want a corrupt capture error", lengths, m, err)
+		}
+	}
+}
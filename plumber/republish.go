@@ -0,0 +1,64 @@
+package plumber
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Default topic tree normalized messages are republished under
+const defaultRepublishPrefix = "plumber/normalized"
+
+// Parse a republish rule value, the topic prefix to republish under
+func parseRepublishPrefix(value string) (interface{}, error) {
+	prefix := strings.Trim(value, "/")
+	if len(prefix) == 0 {
+		prefix = defaultRepublishPrefix
+	}
+	if strings.ContainsAny(prefix, "+#") {
+		return nil, fmt.Errorf("republish prefix %q can't contain wildcards", prefix)
+	}
+	return prefix, nil
+}
+
+// Is the topic something we republished ourselves
+func (p *Plumber) isRepublished(topic string) bool {
+	for _, rule := range p.republishRules {
+		if strings.HasPrefix(topic, rule.Value.(string)+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Republish the normalized message to the mirrored topic tree on the broker
+// it came from, e.g. `plumber/normalized/owntracks/ian/phone`
+func (p *Plumber) republish(broker *Broker, messageTopic string, data map[string]interface{}, received time.Time) {
+	rule := p.republishRules.Match(messageTopic)
+	if rule == nil || p.isRepublished(messageTopic) {
+		return
+	}
+
+	normalized := make(map[string]interface{}, len(data)+1)
+	for key, value := range data {
+		normalized[key] = value
+	}
+	normalized["received"] = received.Format(time.RFC3339Nano)
+
+	payload, err := json.Marshal(normalized)
+	if err != nil {
+		status("PUB", ERR, fmt.Sprintln("Failed to encode normalized message", messageTopic, err))
+		return
+	}
+
+	pubTopic := rule.Value.(string) + "/" + messageTopic
+	broker.client.Publish(pubTopic, broker.Qos, false, payload, nil, func(err error) {
+		if err != nil {
+			status("PUB", ERR, fmt.Sprintln("Failed to republish message", pubTopic, err))
+			p.report(err)
+		} else if p.config.Verbose {
+			status("PUB", OK, fmt.Sprintln("Normalized message republished to", pubTopic))
+		}
+	})
+}
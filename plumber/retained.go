@@ -0,0 +1,35 @@
+package plumber
+
+import (
+	"fmt"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+)
+
+// What to do with retained messages, which the broker sends on subscribing
+// and hold state from before plumber was watching rather than new data
+const (
+	retainedPersist = "persist" // persist them with a retained marker (default)
+	retainedCache   = "cache"   // only seed the last value cache
+	retainedSkip    = "skip"    // ignore them entirely
+)
+
+// Parse a retained rule value, one of the modes above
+func parseRetainedMode(value string) (interface{}, error) {
+	switch value {
+	case retainedPersist, retainedCache, retainedSkip:
+		return value, nil
+	}
+	return nil, fmt.Errorf("unknown retained mode %q (want persist, cache or skip)", value)
+}
+
+// How to handle the message if it's retained, empty for live messages
+func (p *Plumber) retainedMode(message MQTT.Message) string {
+	if !message.Retained() {
+		return ""
+	}
+	if rule := p.retainedRules.Match(message.Topic()); rule != nil {
+		return rule.Value.(string)
+	}
+	return retainedPersist
+}
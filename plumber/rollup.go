@@ -0,0 +1,236 @@
+package plumber
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RollupWindow is an aggregation window, e.g. 1m
+type RollupWindow struct {
+	Name     string // as configured, used in the series name
+	Duration time.Duration
+}
+
+// RollupSpec lists the windows to aggregate a topic's numeric fields over,
+// and optionally which fields (default is all numeric fields)
+type RollupSpec struct {
+	Windows []RollupWindow
+	Fields  []string
+}
+
+// Parse a `window|window[:field|field]` rollup rule value, e.g. "1m|1h:batt"
+func parseRollupSpec(value string) (interface{}, error) {
+	parts := strings.SplitN(value, ":", 2)
+	spec := &RollupSpec{}
+
+	for _, name := range strings.Split(parts[0], "|") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		d, err := time.ParseDuration(name)
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("invalid rollup window %q", name)
+		}
+		spec.Windows = append(spec.Windows, RollupWindow{name, d})
+	}
+
+	if len(spec.Windows) == 0 {
+		return nil, fmt.Errorf("missing rollup window")
+	}
+
+	if len(parts) > 1 {
+		for _, field := range strings.Split(parts[1], "|") {
+			if field = strings.TrimSpace(field); len(field) > 0 {
+				spec.Fields = append(spec.Fields, field)
+			}
+		}
+	}
+
+	return spec, nil
+}
+
+// Aggregate of one field over one window
+type Aggregate struct {
+	Min, Max, Sum, Last float64
+	Count               int
+	last                time.Time // point time of Last
+}
+
+func (a *Aggregate) add(value float64, t time.Time) {
+	if a.Count == 0 || value < a.Min {
+		a.Min = value
+	}
+	if a.Count == 0 || value > a.Max {
+		a.Max = value
+	}
+	if a.Count == 0 || !t.Before(a.last) {
+		a.Last = value
+		a.last = t
+	}
+	a.Sum += value
+	a.Count++
+}
+
+type rollupKey struct {
+	series, broker, topic, field string
+	window                       RollupWindow
+	start                        int64 // window start, unix nanos
+}
+
+// Rollups aggregates numeric fields into fixed windows, writing each window
+// once it has closed and the grace period for late messages has passed
+type Rollups struct {
+	sync.Mutex
+	rules      Rules
+	timestamps Rules // payload timestamp fields, never aggregated
+	grace      time.Duration
+	windows    map[rollupKey]*Aggregate
+	late       int // messages dropped for arriving after their window was written
+	write      func(name string, data map[string]interface{}, t time.Time) error
+	verbose    bool
+	stop, done chan struct{}
+}
+
+func NewRollups(rules Rules, timestamps Rules, grace time.Duration, write func(name string, data map[string]interface{}, t time.Time) error, verbose bool) *Rollups {
+	return &Rollups{rules: rules, timestamps: timestamps, grace: grace, windows: make(map[rollupKey]*Aggregate), write: write, verbose: verbose}
+}
+
+// Add the numeric fields of a point to its windows
+func (r *Rollups) Add(series string, messageTopic string, data map[string]interface{}, t time.Time) {
+	rule := r.rules.Match(messageTopic)
+	if rule == nil {
+		return
+	}
+	spec := rule.Value.(*RollupSpec)
+	broker, _ := data["broker"].(string)
+
+	fields := spec.Fields
+	if len(fields) == 0 {
+		// Every field but the payload timestamp, min/max/mean of which
+		// mean nothing
+		var timestamp string
+		if rule := r.timestamps.Match(messageTopic); rule != nil {
+			timestamp = rule.Value.(*TimestampField).Name
+		}
+		for field := range data {
+			if field != timestamp {
+				fields = append(fields, field)
+			}
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	for _, window := range spec.Windows {
+		start := t.Truncate(window.Duration)
+		if now.After(start.Add(window.Duration + r.grace)) {
+			r.late++
+			if r.verbose {
+				status("", WARN, fmt.Sprintf("Dropping late point on %s from rollup %s (%d so far)\n", messageTopic, window.Name, r.late))
+			}
+			continue
+		}
+
+		for _, field := range fields {
+			value, ok := data[field].(float64)
+			if !ok {
+				continue
+			}
+
+			key := rollupKey{series, broker, messageTopic, field, window, start.UnixNano()}
+			aggregate, ok := r.windows[key]
+			if !ok {
+				aggregate = &Aggregate{}
+				r.windows[key] = aggregate
+			}
+			aggregate.add(value, t)
+		}
+	}
+}
+
+// Flush writes every window that closed more than the grace period ago
+func (r *Rollups) Flush(now time.Time) {
+	r.flush(func(key rollupKey) bool {
+		return now.After(time.Unix(0, key.start).Add(key.window.Duration + r.grace))
+	})
+}
+
+// Write and forget the windows that are due
+func (r *Rollups) flush(due func(key rollupKey) bool) {
+	r.Lock()
+	var keys []rollupKey
+	aggregates := make(map[rollupKey]*Aggregate)
+	for key, aggregate := range r.windows {
+		if due(key) {
+			keys = append(keys, key)
+			aggregates[key] = aggregate
+			delete(r.windows, key)
+		}
+	}
+	r.Unlock()
+
+	sort.Sort(byWindowStart(keys))
+	for _, key := range keys {
+		aggregate := aggregates[key]
+		data := map[string]interface{}{
+			"topic": key.topic,
+			"field": key.field,
+			"min":   aggregate.Min,
+			"max":   aggregate.Max,
+			"mean":  aggregate.Sum / float64(aggregate.Count),
+			"count": aggregate.Count,
+			"last":  aggregate.Last,
+		}
+		if len(key.broker) > 0 {
+			data["broker"] = key.broker
+		}
+		r.write(key.series+".rollup."+key.window.Name, data, time.Unix(0, key.start))
+	}
+
+	if len(keys) > 0 && r.verbose {
+		status("DB", OK, fmt.Sprintf("Persisted %d rollups\n", len(keys)))
+	}
+}
+
+// Flush every interval, in the background until Stop
+func (r *Rollups) Run(interval time.Duration) {
+	r.stop, r.done = make(chan struct{}), make(chan struct{})
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				r.Flush(now)
+			case <-stop:
+				return
+			}
+		}
+	}(r.stop, r.done)
+}
+
+// Stop flushing and write every window, open ones as they stand rather than
+// losing them
+func (r *Rollups) Stop() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.stop, r.done = nil, nil
+
+	r.flush(func(key rollupKey) bool { return true })
+}
+
+type byWindowStart []rollupKey
+
+func (k byWindowStart) Len() int           { return len(k) }
+func (k byWindowStart) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+func (k byWindowStart) Less(i, j int) bool { return k[i].start < k[j].start }
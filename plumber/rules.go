@@ -0,0 +1,63 @@
+package plumber
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rule pairs an MQTT topic filter with a per-topic option value
+type Rule struct {
+	Filter string
+	Value  interface{}
+	parser *Parser
+}
+
+// Rules is an ordered list of topic rules, first match wins
+type Rules []*Rule
+
+// ParseRules parses a comma-separated list of `filter=value` pairs, e.g.
+// "owntracks/#=tst:s,sensors/+/temp=time:ms". Each value is handed to parse,
+// and the result is kept as the rule's Value.
+func ParseRules(spec string, parse func(value string) (interface{}, error)) (Rules, error) {
+	var rules Rules
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		filter := strings.TrimSpace(parts[0])
+		if len(filter) == 0 {
+			return nil, fmt.Errorf("missing topic filter in rule %q", entry)
+		}
+
+		var value string
+		if len(parts) > 1 {
+			value = strings.TrimSpace(parts[1])
+		}
+
+		parsed, err := parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %s", entry, err)
+		}
+
+		rules = append(rules, &Rule{Filter: filter, Value: parsed, parser: Parse(filter)})
+	}
+	return rules, nil
+}
+
+// Match returns the first rule whose filter matches the topic, or nil
+func (rules Rules) Match(topic string) *Rule {
+	for _, rule := range rules {
+		if rule.Match(topic) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Match reports whether the rule's filter matches the topic
+func (rule *Rule) Match(topic string) bool {
+	return rule.parser.Match(topic)
+}
@@ -0,0 +1,658 @@
+package plumber
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+	"github.com/impressiver/mqtt-plumber/mqtt5"
+)
+
+//
+// Embedded broker
+//
+
+// Broker uri that attaches to the embedded broker in-process
+const embeddedScheme = "embedded://"
+
+const (
+	serverConnectTimeout = 10 * time.Second // to send CONNECT after connecting
+	serverWriteTimeout   = 10 * time.Second // slow subscribers are dropped
+	serverRetryInterval  = 20 * time.Second // to resend unacknowledged QoS 1 messages
+	serverMaxRetries     = 3                // resends before a message is dropped
+)
+
+// Message routed by the embedded broker. It has the methods of the paho
+// Message interface.
+type serverMessage struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+}
+
+func (m *serverMessage) Duplicate() bool   { return false }
+func (m *serverMessage) Qos() byte         { return m.qos }
+func (m *serverMessage) Retained() bool    { return m.retained }
+func (m *serverMessage) Topic() string     { return m.topic }
+func (m *serverMessage) MessageID() uint16 { return 0 }
+func (m *serverMessage) Payload() []byte   { return m.payload }
+
+// Copy of the message as delivered at a qos, and flagged retained or not
+func (m *serverMessage) at(qos byte, retained bool) *serverMessage {
+	if qos > m.qos {
+		qos = m.qos
+	}
+	return &serverMessage{m.topic, m.payload, qos, retained}
+}
+
+// A subscription of a network session, or of an attached client's handler
+type serverSub struct {
+	filter  string
+	parser  *Parser
+	qos     byte
+	session *session
+	local   *localClient
+	handler MQTT.MessageHandler
+}
+
+// Server is a minimal MQTT 3.1.1 broker: QoS 0 and 1 (QoS 2 publishes are
+// accepted, subscriptions are granted QoS 1 at most), retained messages and
+// wildcard subscriptions. Sessions are not persisted, every connection starts
+// clean.
+type Server struct {
+	listener      net.Listener
+	verbose       bool
+	retryInterval time.Duration
+
+	sync.Mutex
+	sessions map[string]*session // by client id
+	subs     []*serverSub
+	retained map[string]*serverMessage // by topic
+	lastID   int                       // for generated client ids
+}
+
+// Listen for MQTT connections on addr, e.g. :1883
+func Listen(addr string, verbose bool) (*Server, error) {
+	return listenServer(addr, verbose, serverRetryInterval)
+}
+
+func listenServer(addr string, verbose bool, retryInterval time.Duration) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener:      listener,
+		verbose:       verbose,
+		retryInterval: retryInterval,
+		sessions:      make(map[string]*session),
+		retained:      make(map[string]*serverMessage),
+	}
+	go s.accept()
+
+	status("MQTT", OK, fmt.Sprintf("Embedded broker listening on %s\n", listener.Addr()))
+	return s, nil
+}
+
+// Addr the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close the listener and every connection
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.Lock()
+	for _, session := range s.sessions {
+		session.conn.Close()
+	}
+	s.Unlock()
+	return err
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+// Route a message to every matching subscription, keeping it if retained
+func (s *Server) publish(m *serverMessage) {
+	s.Lock()
+	if m.retained {
+		if len(m.payload) == 0 {
+			delete(s.retained, m.topic)
+		} else {
+			s.retained[m.topic] = m.at(m.qos, true)
+		}
+	}
+
+	// Sessions get a message once, at the highest qos of their matching
+	// subscriptions. Attached clients, like paho, call every matching handler.
+	sessions := make(map[*session]byte)
+	var locals []*serverSub
+	for _, sub := range s.subs {
+		if !sub.parser.Match(m.topic) {
+			continue
+		}
+		if sub.local != nil {
+			locals = append(locals, sub)
+		} else if qos, ok := sessions[sub.session]; !ok || sub.qos > qos {
+			sessions[sub.session] = sub.qos
+		}
+	}
+	s.Unlock()
+
+	for session, qos := range sessions {
+		session.send(m.at(qos, false))
+	}
+	for _, sub := range locals {
+		sub.local.enqueue(sub.handler, m.at(sub.qos, false))
+	}
+}
+
+// Add a subscription, replacing the subscriber's previous one to the same
+// filter, and return the retained messages it matches
+func (s *Server) subscribe(sub *serverSub) []*serverMessage {
+	s.Lock()
+	defer s.Unlock()
+
+	s.removeSubs(func(old *serverSub) bool {
+		return old.filter == sub.filter && old.session == sub.session && old.local == sub.local
+	})
+	s.subs = append(s.subs, sub)
+
+	var retained []*serverMessage
+	for _, m := range s.retained {
+		if sub.parser.Match(m.topic) {
+			retained = append(retained, m.at(sub.qos, true))
+		}
+	}
+	return retained
+}
+
+// Remove the subscriptions matching remove. Call with the lock held.
+func (s *Server) removeSubs(remove func(sub *serverSub) bool) {
+	subs := s.subs[:0]
+	for _, sub := range s.subs {
+		if !remove(sub) {
+			subs = append(subs, sub)
+		}
+	}
+	for i := len(subs); i < len(s.subs); i++ {
+		s.subs[i] = nil
+	}
+	s.subs = subs
+}
+
+func (s *Server) unsubscribe(filters []string, session *session, local *localClient) {
+	s.Lock()
+	defer s.Unlock()
+	for _, filter := range filters {
+		s.removeSubs(func(sub *serverSub) bool {
+			return sub.filter == filter && sub.session == session && sub.local == local
+		})
+	}
+}
+
+// Whether a subscription filter is valid: `#` only as the last level, and
+// wildcards only as whole levels
+func validFilter(filter string) bool {
+	if len(filter) == 0 {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) > 1 {
+			return false
+		}
+		if level == "#" && i < len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether a topic name is valid to publish to
+func validTopic(topic string) bool {
+	return len(topic) > 0 && !strings.ContainsAny(topic, "+#")
+}
+
+//
+// Network sessions
+//
+
+type session struct {
+	server *Server
+	conn   net.Conn
+	id     string
+	will   *serverMessage
+
+	wmu sync.Mutex // serializes writes
+
+	sync.Mutex
+	lastID   uint16
+	inflight map[uint16]*inflightMessage // QoS 1 messages sent and not acked
+	received map[uint16]bool             // QoS 2 messages received and not released
+	closed   bool
+	done     chan struct{} // closed with the session
+}
+
+// A QoS 1 message waiting for its PUBACK
+type inflightMessage struct {
+	message *serverMessage
+	sent    time.Time
+	retries int
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(serverConnectTimeout))
+	cp, err := packets.ReadPacket(conn)
+	if err != nil {
+		return
+	}
+	connect, ok := cp.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = connect.Validate()
+	if len(connect.ClientIdentifier) == 0 && !connect.CleanSession {
+		connack.ReturnCode = packets.ErrRefusedIDRejected
+	}
+	if connack.ReturnCode != packets.Accepted {
+		connack.Write(conn)
+		return
+	}
+
+	sess := &session{
+		server:   s,
+		conn:     conn,
+		id:       connect.ClientIdentifier,
+		inflight: make(map[uint16]*inflightMessage),
+		received: make(map[uint16]bool),
+		done:     make(chan struct{}),
+	}
+	if connect.WillFlag {
+		sess.will = &serverMessage{connect.WillTopic, connect.WillMessage, connect.WillQos, connect.WillRetain}
+	}
+
+	// A client connecting again takes over from its previous connection
+	s.Lock()
+	if len(sess.id) == 0 {
+		s.lastID++
+		sess.id = fmt.Sprintf("embedded-%d", s.lastID)
+	}
+	previous := s.sessions[sess.id]
+	s.sessions[sess.id] = sess
+	s.Unlock()
+	if previous != nil {
+		previous.conn.Close()
+	}
+
+	if err := sess.write(connack); err != nil {
+		sess.close(true)
+		return
+	}
+	if s.verbose {
+		status("MQTT", INFO, fmt.Sprintf("Client %s connected from %s\n", sess.id, conn.RemoteAddr()))
+	}
+
+	go sess.retry(s.retryInterval)
+
+	keepAlive := time.Duration(connect.KeepaliveTimer) * time.Second * 3 / 2
+	sess.close(!sess.read(keepAlive))
+}
+
+// Handle packets until the client disconnects, returning whether it did so
+// cleanly. Malformed packets can make the paho decoder panic, that drops the
+// connection.
+func (sess *session) read(keepAlive time.Duration) (clean bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			status("MQTT", ERR, fmt.Sprintf("Dropping client %s: %v\n", sess.id, r))
+			clean = false
+		}
+	}()
+
+	for {
+		if keepAlive > 0 {
+			sess.conn.SetReadDeadline(time.Now().Add(keepAlive))
+		} else {
+			sess.conn.SetReadDeadline(time.Time{})
+		}
+
+		cp, err := packets.ReadPacket(sess.conn)
+		if err != nil {
+			return false
+		}
+
+		switch p := cp.(type) {
+		case *packets.PublishPacket:
+			if !validTopic(p.TopicName) {
+				return false
+			}
+			sess.onPublish(p)
+		case *packets.PubackPacket:
+			sess.Lock()
+			delete(sess.inflight, p.MessageID)
+			sess.Unlock()
+		case *packets.PubrelPacket:
+			sess.Lock()
+			delete(sess.received, p.MessageID)
+			sess.Unlock()
+			pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pubcomp.MessageID = p.MessageID
+			sess.write(pubcomp)
+		case *packets.SubscribePacket:
+			sess.onSubscribe(p)
+		case *packets.UnsubscribePacket:
+			sess.server.unsubscribe(p.Topics, sess, nil)
+			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			unsuback.MessageID = p.MessageID
+			sess.write(unsuback)
+		case *packets.PingreqPacket:
+			sess.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return true
+		default:
+			// CONNECT again, or packets only servers send
+			return false
+		}
+	}
+}
+
+func (sess *session) onPublish(p *packets.PublishPacket) {
+	m := &serverMessage{p.TopicName, p.Payload, p.Qos, p.Retain}
+
+	switch p.Qos {
+	case 0:
+		sess.server.publish(m)
+	case 1:
+		sess.server.publish(m)
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = p.MessageID
+		sess.write(puback)
+	case 2:
+		// Route once, however often the client resends before PUBREL
+		sess.Lock()
+		seen := sess.received[p.MessageID]
+		sess.received[p.MessageID] = true
+		sess.Unlock()
+		if !seen {
+			sess.server.publish(m)
+		}
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = p.MessageID
+		sess.write(pubrec)
+	}
+}
+
+func (sess *session) onSubscribe(p *packets.SubscribePacket) {
+	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	suback.MessageID = p.MessageID
+
+	var retained []*serverMessage
+	for i, filter := range p.Topics {
+		if !validFilter(filter) {
+			suback.GrantedQoss = append(suback.GrantedQoss, 0x80)
+			continue
+		}
+
+		qos := p.Qoss[i]
+		if qos > 1 {
+			qos = 1
+		}
+		suback.GrantedQoss = append(suback.GrantedQoss, qos)
+		retained = append(retained, sess.server.subscribe(&serverSub{filter: filter, parser: Parse(filter), qos: qos, session: sess})...)
+	}
+
+	// Retained messages go out after the SUBACK
+	sess.write(suback)
+	for _, m := range retained {
+		sess.send(m)
+	}
+}
+
+// Send a message to the client
+func (sess *session) send(m *serverMessage) {
+	var id uint16
+	if m.qos > 0 {
+		sess.Lock()
+		if len(sess.inflight) >= 0xffff {
+			sess.Unlock()
+			status("MQTT", WARN, fmt.Sprintf("Dropping message on %s for %s, too many unacknowledged\n", m.topic, sess.id))
+			return
+		}
+		for {
+			sess.lastID++
+			if _, ok := sess.inflight[sess.lastID]; sess.lastID != 0 && !ok {
+				break
+			}
+		}
+		id = sess.lastID
+		sess.inflight[id] = &inflightMessage{message: m, sent: time.Now()}
+		sess.Unlock()
+	}
+
+	sess.write(publishPacket(m, id, false))
+}
+
+func publishPacket(m *serverMessage, id uint16, dup bool) *packets.PublishPacket {
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = m.topic
+	publish.Payload = m.payload
+	publish.Qos = m.qos
+	publish.Retain = m.retained
+	publish.MessageID = id
+	publish.Dup = dup
+	return publish
+}
+
+// Resend QoS 1 messages that weren't acknowledged within the interval, until
+// the session closes. Messages still unacknowledged after serverMaxRetries
+// resends are dropped.
+func (sess *session) retry(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sess.done:
+			return
+		case now := <-ticker.C:
+			sess.resend(now, interval)
+		}
+	}
+}
+
+func (sess *session) resend(now time.Time, interval time.Duration) {
+	var due []*packets.PublishPacket
+	sess.Lock()
+	for id, inflight := range sess.inflight {
+		if now.Sub(inflight.sent) < interval {
+			continue
+		}
+		if inflight.retries >= serverMaxRetries {
+			delete(sess.inflight, id)
+			status("MQTT", WARN, fmt.Sprintf("Dropping message on %s for %s, not acknowledged\n", inflight.message.topic, sess.id))
+			continue
+		}
+		inflight.retries++
+		inflight.sent = now
+		due = append(due, publishPacket(inflight.message, id, true))
+	}
+	sess.Unlock()
+
+	for _, publish := range due {
+		if sess.write(publish) != nil {
+			return
+		}
+	}
+}
+
+func (sess *session) write(cp packets.ControlPacket) error {
+	sess.wmu.Lock()
+	defer sess.wmu.Unlock()
+
+	sess.conn.SetWriteDeadline(time.Now().Add(serverWriteTimeout))
+	err := cp.Write(sess.conn)
+	if err != nil {
+		// The read loop sees the closed connection and cleans up
+		sess.conn.Close()
+	}
+	return err
+}
+
+// Drop the session and its subscriptions, publishing the will unless the
+// client disconnected cleanly
+func (sess *session) close(publishWill bool) {
+	sess.Lock()
+	if sess.closed {
+		sess.Unlock()
+		return
+	}
+	sess.closed = true
+	close(sess.done)
+	sess.Unlock()
+	sess.conn.Close()
+
+	s := sess.server
+	s.Lock()
+	if s.sessions[sess.id] == sess {
+		delete(s.sessions, sess.id)
+	}
+	s.removeSubs(func(sub *serverSub) bool {
+		return sub.session == sess
+	})
+	s.Unlock()
+
+	if publishWill && sess.will != nil && validTopic(sess.will.topic) {
+		s.publish(sess.will)
+	}
+	if s.verbose {
+		status("MQTT", INFO, fmt.Sprintf("Client %s disconnected\n", sess.id))
+	}
+}
+
+//
+// Attached clients
+//
+
+// Attach a client to the broker in-process, without the network. Its handlers
+// are called one at a time, in order, as with paho.
+func (s *Server) Attach(opts *ClientOptions) Client {
+	c := &localClient{server: s, id: opts.ClientID}
+	c.ready = sync.NewCond(&c.Mutex)
+	go c.dispatch()
+	return c
+}
+
+// Client attached to the embedded broker
+type localClient struct {
+	server *Server
+	id     string
+
+	sync.Mutex
+	ready  *sync.Cond
+	queue  []delivery // unbounded, handlers may publish to themselves
+	closed bool
+}
+
+type delivery struct {
+	handler MQTT.MessageHandler
+	message *serverMessage
+}
+
+func (c *localClient) enqueue(handler MQTT.MessageHandler, m *serverMessage) {
+	c.Lock()
+	if !c.closed {
+		c.queue = append(c.queue, delivery{handler, m})
+		c.ready.Signal()
+	}
+	c.Unlock()
+}
+
+func (c *localClient) dispatch() {
+	for {
+		c.Lock()
+		for len(c.queue) == 0 && !c.closed {
+			c.ready.Wait()
+		}
+		if c.closed {
+			c.Unlock()
+			return
+		}
+		d := c.queue[0]
+		c.queue[0] = delivery{}
+		c.queue = c.queue[1:]
+		c.Unlock()
+
+		d.handler(nil, d.message)
+	}
+}
+
+func (c *localClient) Subscribe(filter string, qos byte, handler MQTT.MessageHandler) error {
+	if !validFilter(filter) {
+		return fmt.Errorf("invalid topic filter %q", filter)
+	}
+	if qos > 1 {
+		qos = 1
+	}
+	for _, m := range c.server.subscribe(&serverSub{filter: filter, parser: Parse(filter), qos: qos, local: c, handler: handler}) {
+		c.enqueue(handler, m)
+	}
+	return nil
+}
+
+func (c *localClient) Unsubscribe(filters ...string) error {
+	c.server.unsubscribe(filters, nil, c)
+	return nil
+}
+
+func (c *localClient) Publish(topic string, qos byte, retained bool, payload []byte, props *mqtt5.Properties, done func(err error)) {
+	var err error
+	if validTopic(topic) {
+		c.server.publish(&serverMessage{topic, payload, qos, retained})
+	} else {
+		err = fmt.Errorf("invalid topic %q", topic)
+	}
+	if done != nil {
+		done(err)
+	}
+}
+
+func (c *localClient) Disconnect(quiesce uint) {
+	s := c.server
+	s.Lock()
+	s.removeSubs(func(sub *serverSub) bool {
+		return sub.local == c
+	})
+	s.Unlock()
+
+	c.Lock()
+	c.closed = true
+	c.queue = nil
+	c.ready.Signal()
+	c.Unlock()
+}
+
+func (c *localClient) SharedSubscriptions() bool {
+	return false
+}
@@ -0,0 +1,212 @@
+package plumber
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git/packets"
+)
+
+// A point written to the test sink
+type testPoint struct {
+	series string
+	data   map[string]interface{}
+	t      time.Time
+}
+
+// Sink keeping points in memory
+type testSink struct {
+	sync.Mutex
+	points []testPoint
+	added  chan struct{}
+	err    error // returned by Write, if set
+}
+
+func newTestSink() *testSink {
+	return &testSink{added: make(chan struct{}, 100)}
+}
+
+func (s *testSink) Write(series string, data map[string]interface{}, t time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.points = append(s.points, testPoint{series, data, t})
+	s.added <- struct{}{}
+	return nil
+}
+
+// Wait for the next point
+func (s *testSink) next(t *testing.T) testPoint {
+	select {
+	case <-s.added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a point")
+	}
+	s.Lock()
+	defer s.Unlock()
+	point := s.points[0]
+	s.points = s.points[1:]
+	return point
+}
+
+func TestEmbeddedBrokerPipeline(t *testing.T) {
+	sink := newTestSink()
+	p, err := New(Config{
+		Broker:   "embedded://",
+		Listen:   "127.0.0.1:0",
+		ClientID: "plumber",
+		Watch:    []string{"sensors/+"},
+		Qos:      1,
+		Clean:    true,
+	}, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Hooks.Error = func(err error) { t.Error(err) }
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	// A network client publishes, the attached watch list persists
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker("tcp://" + p.server.Addr().String())
+	opts.SetClientID("sensor")
+	client := MQTT.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(0)
+
+	if token := client.Publish("sensors/kitchen", 1, false, `{"temp": 21.5}`); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	point := sink.next(t)
+	if point.series != "sensors/+" {
+		t.Errorf("series = %q, want sensors/+", point.series)
+	}
+	if point.data["temp"] != 21.5 || point.data["topic"] != "sensors/kitchen" {
+		t.Errorf("data = %v", point.data)
+	}
+
+	// Unwatched topics aren't persisted
+	client.Publish("other/kitchen", 1, false, `{"temp": 1}`).Wait()
+	client.Publish("sensors/hall", 1, false, `{"temp": 19}`).Wait()
+	if point := sink.next(t); point.data["topic"] != "sensors/hall" {
+		t.Errorf("data = %v, want sensors/hall", point.data)
+	}
+}
+
+// Connect a raw client and subscribe it to filter at QoS 1
+func rawSubscriber(t *testing.T, s *Server, filter string) net.Conn {
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.CleanSession = true
+	connect.ClientIdentifier = "raw"
+	connect.Write(conn)
+	if cp, err := packets.ReadPacket(conn); err != nil {
+		t.Fatal(err)
+	} else if connack, ok := cp.(*packets.ConnackPacket); !ok || connack.ReturnCode != packets.Accepted {
+		t.Fatalf("connack = %v", cp)
+	}
+
+	subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	subscribe.MessageID = 1
+	subscribe.Topics = []string{filter}
+	subscribe.Qoss = []byte{1}
+	subscribe.Write(conn)
+	if cp, err := packets.ReadPacket(conn); err != nil {
+		t.Fatal(err)
+	} else if _, ok := cp.(*packets.SubackPacket); !ok {
+		t.Fatalf("suback = %v", cp)
+	}
+	return conn
+}
+
+// Read a publish, nil if none comes within timeout
+func readPublish(t *testing.T, conn net.Conn, timeout time.Duration) *packets.PublishPacket {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	cp, err := packets.ReadPacket(conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish, ok := cp.(*packets.PublishPacket)
+	if !ok {
+		t.Fatalf("got %v, want a publish", cp)
+	}
+	return publish
+}
+
+func TestServerResendsUnacknowledged(t *testing.T) {
+	interval := 50 * time.Millisecond
+	s, err := listenServer("127.0.0.1:0", false, interval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn := rawSubscriber(t, s, "a/#")
+	defer conn.Close()
+
+	publisher := s.Attach(&ClientOptions{ClientID: "publisher"})
+	defer publisher.Disconnect(0)
+
+	// Acknowledged after the first resend
+	publisher.Publish("a/1", 1, false, []byte("one"), nil, nil)
+	first := readPublish(t, conn, time.Second)
+	if first == nil || first.Dup || first.Qos != 1 {
+		t.Fatalf("first delivery = %v", first)
+	}
+	again := readPublish(t, conn, time.Second)
+	if again == nil || !again.Dup || again.MessageID != first.MessageID || string(again.Payload) != "one" {
+		t.Fatalf("resend = %v", again)
+	}
+	puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	puback.MessageID = first.MessageID
+	puback.Write(conn)
+	if extra := readPublish(t, conn, 4*interval); extra != nil {
+		t.Fatalf("resent after the ack: %v", extra)
+	}
+
+	// Never acknowledged, dropped after the last resend
+	publisher.Publish("a/2", 1, false, []byte("two"), nil, nil)
+	if readPublish(t, conn, time.Second) == nil {
+		t.Fatal("no delivery")
+	}
+	for i := 0; i < serverMaxRetries; i++ {
+		if resend := readPublish(t, conn, time.Second); resend == nil || !resend.Dup {
+			t.Fatalf("resend %d = %v", i+1, resend)
+		}
+	}
+	if extra := readPublish(t, conn, 4*interval); extra != nil {
+		t.Fatalf("resent more than %d times: %v", serverMaxRetries, extra)
+	}
+
+	s.Lock()
+	sessions := len(s.sessions)
+	var inflight int
+	for _, sess := range s.sessions {
+		sess.Lock()
+		inflight += len(sess.inflight)
+		sess.Unlock()
+	}
+	s.Unlock()
+	if sessions != 1 || inflight != 0 {
+		t.Errorf("%d sessions with %d messages in flight, want 1 with none", sessions, inflight)
+	}
+}
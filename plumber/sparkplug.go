@@ -0,0 +1,635 @@
+package plumber
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+)
+
+//
+// Sparkplug B
+//
+
+// Topic namespace of Sparkplug B, `spBv1.0/group/type/edge[/device]`
+const sparkplugNamespace = "spBv1.0"
+
+// Series name prefix for Sparkplug edge nodes and devices, e.g.
+// `sparkplug.plant1.press4.sensor2`
+const sparkplugSeriesPrefix = "sparkplug."
+
+// How often to ask an edge node to rebirth while its aliases are unknown
+const sparkplugRebirthInterval = 10 * time.Second
+
+// Sparkplug B metric datatypes
+const (
+	spInt8            = 1
+	spInt16           = 2
+	spInt32           = 3
+	spInt64           = 4
+	spUInt8           = 5
+	spUInt16          = 6
+	spUInt32          = 7
+	spUInt64          = 8
+	spFloat           = 9
+	spDouble          = 10
+	spBoolean         = 11
+	spString          = 12
+	spDateTime        = 13
+	spText            = 14
+	spUUID            = 15
+	spDataSet         = 16
+	spBytes           = 17
+	spFile            = 18
+	spTemplate        = 19
+	spPropertySet     = 20
+	spPropertySetList = 21
+	spInt8Array       = 22
+	spDateTimeArray   = 34
+)
+
+// SparkplugTopic is a parsed Sparkplug B topic
+type SparkplugTopic struct {
+	Group  string
+	Type   string // NBIRTH, NDATA, NDEATH, DBIRTH, DDATA, DDEATH, NCMD or DCMD
+	Edge   string
+	Device string // empty for edge node messages
+}
+
+// Parse a `spBv1.0/group/type/edge[/device]` topic
+func parseSparkplugTopic(topic string) (*SparkplugTopic, bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 4 || len(parts) > 5 || parts[0] != sparkplugNamespace {
+		return nil, false
+	}
+	t := &SparkplugTopic{Group: parts[1], Type: parts[2], Edge: parts[3]}
+	if len(t.Type) < 2 {
+		return nil, false
+	}
+	if len(parts) == 5 {
+		t.Device = parts[4]
+	}
+
+	// Node messages have no device, device messages need one
+	if strings.HasPrefix(t.Type, "N") != (len(t.Device) == 0) {
+		return nil, false
+	}
+	switch t.Type[1:] {
+	case "BIRTH", "DATA", "DEATH", "CMD":
+		return t, true
+	}
+	return nil, false
+}
+
+// Topic of the edge node, for group ownership: all of a node's messages
+// have to land on the instance that has its aliases
+func (t *SparkplugTopic) node() string {
+	return strings.Join([]string{sparkplugNamespace, t.Group, t.Edge}, "/")
+}
+
+func (t *SparkplugTopic) series() string {
+	name := sparkplugSeriesPrefix + t.Group + "." + t.Edge
+	if len(t.Device) > 0 {
+		name += "." + t.Device
+	}
+	return name
+}
+
+//
+// Payloads
+//
+
+type sparkplugPayload struct {
+	Timestamp uint64 // ms, zero if not sent
+	Seq       uint64
+	HasSeq    bool
+	Metrics   []*sparkplugMetric
+}
+
+type sparkplugMetric struct {
+	Name       string
+	Alias      uint64
+	HasAlias   bool
+	Timestamp  uint64 // ms, zero if not sent
+	Datatype   uint64 // zero if not sent, as in data messages
+	Historical bool
+	Transient  bool
+	Null       bool
+
+	// Raw value, typed once the datatype is known
+	field uint64 // number of the value field that was set
+	v     uint64
+	data  []byte
+}
+
+// Decode an org.eclipse.tahu.protobuf.Payload
+func decodeSparkplugPayload(b []byte) (*sparkplugPayload, error) {
+	payload := &sparkplugPayload{}
+	err := protoFields(b, func(number uint64, wire byte, v uint64, data []byte) error {
+		switch {
+		case number == 1 && wire == wireVarint:
+			payload.Timestamp = v
+		case number == 2 && wire == wireBytes:
+			metric, err := decodeSparkplugMetric(data)
+			if err != nil {
+				return err
+			}
+			payload.Metrics = append(payload.Metrics, metric)
+		case number == 3 && wire == wireVarint:
+			payload.Seq, payload.HasSeq = v, true
+		}
+		return nil
+	})
+	return payload, err
+}
+
+func decodeSparkplugMetric(b []byte) (*sparkplugMetric, error) {
+	metric := &sparkplugMetric{}
+	err := protoFields(b, func(number uint64, wire byte, v uint64, data []byte) error {
+		switch number {
+		case 1:
+			metric.Name = string(data)
+		case 2:
+			metric.Alias, metric.HasAlias = v, true
+		case 3:
+			metric.Timestamp = v
+		case 4:
+			metric.Datatype = v
+		case 5:
+			metric.Historical = v != 0
+		case 6:
+			metric.Transient = v != 0
+		case 7:
+			metric.Null = v != 0
+		case 10, 11, 12, 13, 14, 15, 16, 17, 18, 19:
+			metric.field, metric.v, metric.data = number, v, data
+		}
+		return nil
+	})
+	return metric, err
+}
+
+// Typed value of a metric given its datatype: numbers are float64, dates
+// ISO-8601 strings and bytes base64 encoded. Template instances are maps of
+// their members, ok is false for values that aren't supported (data sets,
+// property sets, template definitions).
+func (m *sparkplugMetric) value(datatype uint64, depth int) (interface{}, bool) {
+	if m.Null {
+		return nil, true
+	}
+
+	switch datatype {
+	case spInt8:
+		return float64(int8(m.v)), true
+	case spInt16:
+		return float64(int16(m.v)), true
+	case spInt32:
+		return float64(int32(m.v)), true
+	case spInt64:
+		return float64(int64(m.v)), true
+	case spUInt8, spUInt16, spUInt32, spUInt64:
+		return float64(m.v), true
+	case spFloat:
+		return finite(float64(math.Float32frombits(uint32(m.v)))), true
+	case spDouble:
+		return finite(math.Float64frombits(m.v)), true
+	case spBoolean:
+		return m.v != 0, true
+	case spString, spText, spUUID:
+		return string(m.data), true
+	case spDateTime:
+		return time.Unix(0, int64(m.v)*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano), true
+	case spBytes, spFile:
+		return base64.StdEncoding.EncodeToString(m.data), true
+	case spTemplate:
+		return m.template(depth)
+	case spDataSet, spPropertySet, spPropertySetList:
+		return nil, false
+	case 0:
+		return m.untyped(), true
+	}
+
+	if datatype >= spInt8Array && datatype <= spDateTimeArray {
+		return sparkplugArray(datatype, m.data)
+	}
+	return nil, false
+}
+
+// Value by whichever field was set, for metrics whose datatype is unknown
+func (m *sparkplugMetric) untyped() interface{} {
+	switch m.field {
+	case 10, 11:
+		return float64(m.v)
+	case 12:
+		return finite(float64(math.Float32frombits(uint32(m.v))))
+	case 13:
+		return finite(math.Float64frombits(m.v))
+	case 14:
+		return m.v != 0
+	case 15:
+		return string(m.data)
+	case 16:
+		return base64.StdEncoding.EncodeToString(m.data)
+	}
+	return nil
+}
+
+// Members of a template instance, by name
+func (m *sparkplugMetric) template(depth int) (interface{}, bool) {
+	if depth >= maxBinaryDepth {
+		return nil, false
+	}
+
+	members := make(map[string]interface{})
+	definition := false
+	err := protoFields(m.data, func(number uint64, wire byte, v uint64, data []byte) error {
+		switch {
+		case number == 2 && wire == wireBytes:
+			member, err := decodeSparkplugMetric(data)
+			if err != nil {
+				return err
+			}
+			if value, ok := member.value(member.Datatype, depth+1); ok {
+				members[member.Name] = value
+			}
+		case number == 5 && wire == wireVarint:
+			definition = v != 0
+		}
+		return nil
+	})
+	if err != nil || definition {
+		return nil, false
+	}
+	return members, true
+}
+
+// Element widths of the fixed width array datatypes
+var sparkplugArrayWidths = map[uint64]int{
+	22: 1, 23: 2, 24: 4, 25: 8, // Int8Array to Int64Array
+	26: 1, 27: 2, 28: 4, 29: 8, // UInt8Array to UInt64Array
+	30: 4, 31: 8, 34: 8, // FloatArray, DoubleArray, DateTimeArray
+}
+
+// Decode the little-endian packed array in a metric's bytes value
+func sparkplugArray(datatype uint64, data []byte) (interface{}, bool) {
+	values := []interface{}{}
+
+	switch datatype {
+	case 32:
+		// BooleanArray, a count then bits, most significant first
+		r := &binaryReader{b: data}
+		n, err := r.fixed(4)
+		if err != nil || n > uint64(len(r.b))*8 {
+			return nil, false
+		}
+		for i := uint64(0); i < n; i++ {
+			values = append(values, r.b[i/8]&(0x80>>(i%8)) != 0)
+		}
+		return values, true
+	case 33:
+		// StringArray, null terminated
+		for _, s := range strings.SplitAfter(string(data), "\x00") {
+			if len(s) > 0 {
+				values = append(values, strings.TrimSuffix(s, "\x00"))
+			}
+		}
+		return values, true
+	}
+
+	width, ok := sparkplugArrayWidths[datatype]
+	if !ok || len(data)%width != 0 {
+		return nil, false
+	}
+	r := &binaryReader{b: data}
+	for len(r.b) > 0 {
+		v, _ := r.fixed(uint64(width))
+		var value interface{}
+		switch datatype {
+		case 22:
+			value = float64(int8(v))
+		case 23:
+			value = float64(int16(v))
+		case 24:
+			value = float64(int32(v))
+		case 25:
+			value = float64(int64(v))
+		case 30:
+			value = finite(float64(math.Float32frombits(uint32(v))))
+		case 31:
+			value = finite(math.Float64frombits(v))
+		case 34:
+			value = time.Unix(0, int64(v)*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+		default:
+			value = float64(v)
+		}
+		values = append(values, value)
+	}
+	return values, true
+}
+
+//
+// Edge node state
+//
+
+// What an edge node's birth certificates told us
+type sparkplugNode struct {
+	born      bool
+	aliases   map[uint64]string // metric names, unique across the node and its devices
+	datatypes map[string]uint64 // by device and metric name
+	seq       uint64
+	bdSeq     interface{} // of the birth, NDEATHs with another are stale
+	rebirthAt time.Time
+}
+
+type sparkplugNodes struct {
+	sync.Mutex
+	nodes map[string]*sparkplugNode
+}
+
+func newSparkplugNodes() *sparkplugNodes {
+	return &sparkplugNodes{nodes: make(map[string]*sparkplugNode)}
+}
+
+// A point per distinct metric timestamp
+type sparkplugPoint struct {
+	t    time.Time
+	data map[string]interface{}
+}
+
+// Apply a message to its edge node's state, returning its points and
+// whether the node should be asked to rebirth (unknown aliases, sequence
+// gaps, or a node we haven't seen born)
+func (s *sparkplugNodes) apply(broker string, topic *SparkplugTopic, payload *sparkplugPayload, received time.Time) (points []*sparkplugPoint, rebirth bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := broker + " " + topic.node()
+	node := s.nodes[key]
+	if node == nil || topic.Type == "NBIRTH" {
+		node = &sparkplugNode{aliases: make(map[uint64]string), datatypes: make(map[string]uint64)}
+		s.nodes[key] = node
+	}
+
+	switch topic.Type {
+	case "NBIRTH":
+		node.born, node.seq = true, payload.Seq
+		for _, metric := range payload.Metrics {
+			if metric.Name == "bdSeq" {
+				node.bdSeq, _ = metric.value(metric.Datatype, 0)
+			}
+		}
+	case "NDEATH":
+		// Wills of earlier sessions are stale
+		for _, metric := range payload.Metrics {
+			if bdSeq, _ := metric.value(metric.Datatype, 0); metric.Name == "bdSeq" && node.born && bdSeq != node.bdSeq {
+				return nil, false
+			}
+		}
+		node.born = false
+	case "NCMD", "DCMD":
+		// Commands to the node, not data from it
+		return nil, false
+	default:
+		if !node.born {
+			rebirth = true
+		} else if payload.HasSeq && payload.Seq != (node.seq+1)%256 {
+			status("SUB", WARN, fmt.Sprintf("Sparkplug sequence gap on %s: %d after %d\n", topic.node(), payload.Seq, node.seq))
+			rebirth = true
+		}
+		node.seq = payload.Seq
+	}
+
+	birth := strings.HasSuffix(topic.Type, "BIRTH")
+	byTime := make(map[uint64]map[string]interface{})
+	for _, metric := range payload.Metrics {
+		if birth && metric.HasAlias && len(metric.Name) > 0 {
+			node.aliases[metric.Alias] = metric.Name
+		}
+		if len(metric.Name) == 0 && metric.HasAlias {
+			if metric.Name = node.aliases[metric.Alias]; len(metric.Name) == 0 {
+				rebirth = true
+				continue
+			}
+		}
+
+		typeKey := topic.Device + "/" + metric.Name
+		if birth && metric.Datatype != 0 {
+			node.datatypes[typeKey] = metric.Datatype
+		}
+		datatype := metric.Datatype
+		if datatype == 0 {
+			datatype = node.datatypes[typeKey]
+		}
+
+		// Transient metrics aren't for keeping
+		if metric.Transient || len(metric.Name) == 0 {
+			continue
+		}
+		value, ok := metric.value(datatype, 0)
+		if !ok {
+			continue
+		}
+
+		ts := metric.Timestamp
+		if ts == 0 {
+			ts = payload.Timestamp
+		}
+		data := byTime[ts]
+		if data == nil {
+			data = make(map[string]interface{})
+			byTime[ts] = data
+		}
+		flattenMetric(data, metric.Name, value)
+	}
+
+	// Births and deaths say whether the node or device is online
+	if birth || strings.HasSuffix(topic.Type, "DEATH") {
+		if byTime[payload.Timestamp] == nil {
+			byTime[payload.Timestamp] = make(map[string]interface{})
+		}
+		byTime[payload.Timestamp]["online"] = birth
+	}
+
+	var times []uint64
+	for ts := range byTime {
+		times = append(times, ts)
+	}
+	sort.Sort(uint64s(times))
+	for _, ts := range times {
+		t := received
+		if ts > 0 {
+			t = time.Unix(0, int64(ts)*int64(time.Millisecond))
+		}
+		points = append(points, &sparkplugPoint{t, byTime[ts]})
+	}
+
+	if rebirth {
+		if received.Sub(node.rebirthAt) < sparkplugRebirthInterval {
+			rebirth = false
+		} else {
+			node.rebirthAt = received
+		}
+	}
+	return points, rebirth
+}
+
+// Template members are fields of their own, `template/member`
+func flattenMetric(data map[string]interface{}, name string, value interface{}) {
+	members, ok := value.(map[string]interface{})
+	if !ok {
+		data[name] = value
+		return
+	}
+	for member, value := range members {
+		flattenMetric(data, name+"/"+member, value)
+	}
+}
+
+type uint64s []uint64
+
+func (a uint64s) Len() int           { return len(a) }
+func (a uint64s) Less(i, j int) bool { return a[i] < a[j] }
+func (a uint64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// NCMD payload asking an edge node to publish its births again
+func sparkplugRebirthPayload(t time.Time) []byte {
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+	metric := protoEncoder{}.bytes(1, []byte("Node Control/Rebirth")).varint(3, ms).varint(4, spBoolean).varint(14, 1)
+	return protoEncoder{}.varint(1, ms).bytes(2, metric)
+}
+
+// Appends protobuf fields
+type protoEncoder []byte
+
+func (e protoEncoder) uvarint(v uint64) protoEncoder {
+	for v >= 0x80 {
+		e = append(e, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(e, byte(v))
+}
+
+func (e protoEncoder) varint(number uint64, v uint64) protoEncoder {
+	return e.uvarint(number<<3 | wireVarint).uvarint(v)
+}
+
+func (e protoEncoder) bytes(number uint64, b []byte) protoEncoder {
+	return append(e.uvarint(number<<3|wireBytes).uvarint(uint64(len(b))), b...)
+}
+
+//
+// Messages
+//
+
+func (p *Plumber) onSparkplugMessageReceived(broker *Broker, message MQTT.Message) {
+	topic, ok := parseSparkplugTopic(message.Topic())
+	if ok && !broker.owns(topic.node()) {
+		return
+	}
+	received := time.Now()
+	p.received(broker, message, received)
+
+	if !ok {
+		// Host application STATE and the like
+		if p.config.Verbose {
+			status("SUB", INFO, fmt.Sprintf("Skipping Sparkplug topic: %s\n", message.Topic()))
+		}
+		return
+	}
+
+	if message.Duplicate() {
+		status("SUB", WARN, fmt.Sprintf("Received duplicate message on Sparkplug topic: %s\n", message.Topic()))
+		return
+	}
+	status("SUB", INFO, fmt.Sprintf("Received message on Sparkplug topic: %s\n", message.Topic()))
+
+	mode := p.retainedMode(message)
+	if mode == retainedSkip || p.isDuplicate(broker, message, nil, received) {
+		return
+	}
+
+	payload, err := decodeSparkplugPayload(message.Payload())
+	if err != nil {
+		status("ERR", ERR, fmt.Sprintf("Failed to decode Sparkplug payload on %s: %s\n", message.Topic(), err))
+		return
+	}
+
+	points, rebirth := p.sparkplug.apply(broker.Name, topic, payload, received)
+	if rebirth && p.config.SparkplugRebirth {
+		p.requestRebirth(broker, topic, received)
+	}
+
+	for _, point := range points {
+		data := point.data
+		if p.config.Verbose {
+			value, _ := json.Marshal(data)
+			status("", INFO, fmt.Sprintf("parsed (sparkplug) %s\n", value))
+		}
+
+		// Metrics win over the message's columns
+		columns := map[string]interface{}{
+			"topic": message.Topic(),
+			"type":  topic.Type,
+			"group": topic.Group,
+			"edge":  topic.Edge,
+		}
+		if len(topic.Device) > 0 {
+			columns["device"] = topic.Device
+		}
+		if payload.HasSeq {
+			columns["seq"] = float64(payload.Seq)
+		}
+		broker.tag(columns)
+		for key, value := range columns {
+			if _, ok := data[key]; !ok {
+				data[key] = value
+			}
+		}
+
+		if value, err := json.Marshal(data); err == nil {
+			p.cacheLastValue(broker, message, value, received)
+		}
+		if mode == retainedCache {
+			continue
+		}
+		if mode == retainedPersist {
+			data["retained"] = true
+		}
+
+		if p.alerts != nil {
+			p.alerts.Check(message.Topic(), data, point.t)
+		}
+		p.republish(broker, message.Topic(), data, received)
+		if p.webhooks != nil {
+			p.webhooks.Send(message.Topic(), data, point.t)
+		}
+		series := topic.series()
+		if p.rollups != nil {
+			p.rollups.Add(series, message.Topic(), data, point.t)
+		}
+		if p.write(series, data, point.t) != nil {
+			continue
+		}
+
+		status("DB", OK, fmt.Sprintf("Persisted to series %s (%d fields)\n", series, len(data)))
+	}
+}
+
+// Ask an edge node to publish its births again, on the broker it's on
+func (p *Plumber) requestRebirth(broker *Broker, topic *SparkplugTopic, t time.Time) {
+	cmdTopic := strings.Join([]string{sparkplugNamespace, topic.Group, "NCMD", topic.Edge}, "/")
+	broker.client.Publish(cmdTopic, 0, false, sparkplugRebirthPayload(t), nil, func(err error) {
+		if err != nil {
+			status("PUB", ERR, fmt.Sprintln("Failed to request Sparkplug rebirth", cmdTopic, err))
+			p.report(err)
+		} else {
+			status("PUB", WARN, fmt.Sprintln("Requested Sparkplug rebirth of", topic.node()))
+		}
+	})
+}
@@ -0,0 +1,225 @@
+package plumber
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Series name prefix for decoded $SYS metrics
+const sysSeriesPrefix = "broker."
+
+// SysMetric describes how a $SYS topic maps to a measurement
+type SysMetric struct {
+	Name    string // measurement, e.g. clients.connected
+	Unit    string // e.g. seconds, bytes, messages
+	Counter bool   // monotonic, a per-second rate is derived
+}
+
+// Known topics below $SYS/broker (mosquitto), including names used by older
+// releases. Anything else is named after its topic path.
+var sysMetrics = map[string]SysMetric{
+	"bytes/received":            {"bytes.received", "bytes", true},
+	"bytes/sent":                {"bytes.sent", "bytes", true},
+	"clients/active":            {"clients.connected", "clients", false},
+	"clients/connected":         {"clients.connected", "clients", false},
+	"clients/inactive":          {"clients.disconnected", "clients", false},
+	"clients/disconnected":      {"clients.disconnected", "clients", false},
+	"clients/expired":           {"clients.expired", "clients", false},
+	"clients/maximum":           {"clients.maximum", "clients", false},
+	"clients/total":             {"clients.total", "clients", false},
+	"heap/current":              {"heap.current", "bytes", false},
+	"heap/current size":         {"heap.current", "bytes", false},
+	"heap/maximum":              {"heap.maximum", "bytes", false},
+	"heap/maximum size":         {"heap.maximum", "bytes", false},
+	"messages/inflight":         {"messages.inflight", "messages", false},
+	"messages/received":         {"messages.received", "messages", true},
+	"messages/sent":             {"messages.sent", "messages", true},
+	"messages/stored":           {"messages.stored", "messages", false},
+	"publish/bytes/received":    {"publish.bytes.received", "bytes", true},
+	"publish/bytes/sent":        {"publish.bytes.sent", "bytes", true},
+	"publish/messages/dropped":  {"publish.messages.dropped", "messages", true},
+	"publish/messages/received": {"publish.messages.received", "messages", true},
+	"publish/messages/sent":     {"publish.messages.sent", "messages", true},
+	"retained messages/count":   {"retained.messages", "messages", false},
+	"store/messages/count":      {"store.messages", "messages", false},
+	"store/messages/bytes":      {"store.bytes", "bytes", false},
+	"subscriptions/count":       {"subscriptions", "subscriptions", false},
+	"uptime":                    {"uptime", "seconds", false},
+	"version":                   {"version", "", false},
+	"timestamp":                 {"timestamp", "", false},
+}
+
+// SysValue is a decoded $SYS message
+type SysValue struct {
+	SysMetric
+	Node  string      // broker node, for brokers that publish per-node trees
+	Value interface{} // float64, or string for version etc
+}
+
+// Matches a number followed by an optional unit, e.g. "12345 seconds"
+var reSysNumber = regexp.MustCompile(`^(-?[0-9]+(?:\.[0-9]+)?)\s*([^\s\d].*)?$`)
+
+// Matches the parts of a spelled out duration, e.g. "1 days, 2 hours, 3 seconds"
+var reSysDuration = regexp.MustCompile(`([0-9]+)\s*(day|hour|minute|second)s?`)
+
+var sysDurationUnits = map[string]float64{
+	"day":    24 * 60 * 60,
+	"hour":   60 * 60,
+	"minute": 60,
+	"second": 1,
+}
+
+// Split a $SYS topic into broker node (if any) and the path below it. Supports
+// mosquitto's `$SYS/broker/...` and the per-node `$SYS/brokers/<node>/...`
+// layout (emqttd), anything else is taken as is.
+func sysPath(topic string) (node string, path string) {
+	path = strings.TrimPrefix(topic, "$SYS/")
+	if strings.HasPrefix(path, "broker/") {
+		return "", strings.TrimPrefix(path, "broker/")
+	}
+	if strings.HasPrefix(path, "brokers/") {
+		parts := strings.SplitN(strings.TrimPrefix(path, "brokers/"), "/", 2)
+		if len(parts) == 2 {
+			return parts[0], parts[1]
+		}
+	}
+	return "", path
+}
+
+// Name a metric that isn't in the table after its topic path
+func sysMetricForPath(path string) SysMetric {
+	metric := SysMetric{
+		Name: strings.Replace(strings.Replace(path, "/", ".", -1), " ", "_", -1),
+		// emqttd metrics are counters, stats are gauges
+		Counter: strings.HasPrefix(path, "metrics/"),
+	}
+
+	// mosquitto load averages, e.g. load/messages/received/1min
+	parts := strings.Split(path, "/")
+	if parts[0] == "load" && len(parts) > 1 {
+		switch parts[1] {
+		case "bytes", "connections", "sockets":
+			metric.Unit = parts[1] + "/min"
+		default:
+			metric.Unit = "messages/min"
+		}
+	}
+
+	return metric
+}
+
+// Decode a $SYS message into a named metric with a proper value
+func (p *Plumber) decodeSys(topic string, payload []byte) *SysValue {
+	node, path := sysPath(topic)
+
+	metric, ok := sysMetrics[path]
+	if !ok {
+		metric = sysMetricForPath(path)
+	}
+
+	value := &SysValue{SysMetric: metric, Node: node}
+	raw := strings.TrimSpace(string(payload))
+
+	if m := reSysDuration.FindAllStringSubmatch(raw, -1); m != nil && metric.Name == "uptime" {
+		var seconds float64
+		for _, part := range m {
+			n, _ := strconv.ParseFloat(part[1], 64)
+			seconds += n * sysDurationUnits[part[2]]
+		}
+		value.Value = seconds
+	} else if date, ok, _ := p.detectDate(topic, raw); ok {
+		value.Value = date.Format(time.RFC3339)
+	} else if m := reSysNumber.FindStringSubmatch(raw); m != nil {
+		n, _ := strconv.ParseFloat(m[1], 64)
+		value.Value = n
+		if len(value.Unit) == 0 {
+			value.Unit = strings.TrimSpace(m[2])
+		}
+	} else {
+		value.Value = raw
+	}
+
+	return value
+}
+
+// Last seen counter values, for deriving rates
+type sysCounter struct {
+	value float64
+	t     time.Time
+}
+
+type sysCounters struct {
+	sync.Mutex
+	last map[string]sysCounter
+}
+
+func newSysCounters() *sysCounters {
+	return &sysCounters{last: make(map[string]sysCounter)}
+}
+
+// Per-second rate of change of a broker's counter since it was last seen.
+// Counters that go backwards (broker restart) restart the rate.
+func (c *sysCounters) rate(broker string, value *SysValue, t time.Time) (float64, bool) {
+	n, ok := value.Value.(float64)
+	if !ok || !value.Counter {
+		return 0, false
+	}
+
+	key := broker + " " + value.Node + "/" + value.Name
+
+	c.Lock()
+	defer c.Unlock()
+
+	last, seen := c.last[key]
+	c.last[key] = sysCounter{n, t}
+
+	dt := t.Sub(last.t).Seconds()
+	if !seen || n < last.value || dt <= 0 {
+		return 0, false
+	}
+
+	return (n - last.value) / dt, true
+}
+
+// Decode a $SYS message and persist it, along with the rate for counters
+func (p *Plumber) persistSys(broker *Broker, messageTopic string, payload []byte, retained bool, received time.Time) {
+	value := p.decodeSys(messageTopic, payload)
+
+	point := func(v interface{}, unit string) map[string]interface{} {
+		data := map[string]interface{}{
+			"value": v,
+			"unit":  unit,
+			"topic": messageTopic,
+		}
+		if len(value.Node) > 0 {
+			data["node"] = value.Node
+		}
+		if retained {
+			data["retained"] = true
+		}
+		broker.tag(data)
+		return data
+	}
+
+	name := sysSeriesPrefix + value.Name
+	data := point(value.Value, value.Unit)
+	if p.alerts != nil {
+		p.alerts.Check(messageTopic, data, received)
+	}
+	if p.rollups != nil {
+		p.rollups.Add(name, messageTopic, data, received)
+	}
+	if p.write(name, data, received) != nil {
+		return
+	}
+
+	if rate, ok := p.sysCounters.rate(broker.Name, value, received); ok {
+		p.write(name+".rate", point(rate, value.Unit+"/s"), received)
+	}
+
+	status("DB", OK, fmt.Sprintf("Persisted to series %s (%v %s)\n", name, value.Value, value.Unit))
+}
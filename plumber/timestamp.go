@@ -0,0 +1,105 @@
+package plumber
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimestampField names the payload field holding a message's own timestamp,
+// and the unit of numeric (epoch) values in it
+type TimestampField struct {
+	Name string
+	Unit time.Duration // zero means guess from magnitude
+}
+
+var timestampUnits = map[string]time.Duration{
+	"":   0,
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+// Parse a `field[:unit]` timestamp rule value, e.g. "tst:s"
+func parseTimestampField(value string) (interface{}, error) {
+	parts := strings.SplitN(value, ":", 2)
+	field := &TimestampField{Name: parts[0]}
+	if len(field.Name) == 0 {
+		return nil, fmt.Errorf("missing timestamp field name")
+	}
+
+	if len(parts) > 1 {
+		unit, ok := timestampUnits[parts[1]]
+		if !ok {
+			return nil, fmt.Errorf("unknown timestamp unit %q (want s, ms, us or ns)", parts[1])
+		}
+		field.Unit = unit
+	}
+
+	return field, nil
+}
+
+// Guess the unit of an epoch value by its magnitude
+func epochUnit(epoch float64) time.Duration {
+	switch {
+	case epoch >= 1e17:
+		return time.Nanosecond
+	case epoch >= 1e14:
+		return time.Microsecond
+	case epoch >= 1e11:
+		return time.Millisecond
+	}
+	return time.Second
+}
+
+// Convert a payload timestamp value to a time, numbers are treated as epochs
+// in the given unit and strings as epochs or dates in any of the default layouts
+func (f *TimestampField) Time(value interface{}) (time.Time, error) {
+	var epoch float64
+	switch v := value.(type) {
+	case float64:
+		epoch = v
+	case string:
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return parseDate(defaultDateLayouts, v)
+		}
+		epoch = n
+	default:
+		return time.Time{}, fmt.Errorf("unsupported timestamp value %v", value)
+	}
+
+	unit := f.Unit
+	if unit == 0 {
+		unit = epochUnit(epoch)
+	}
+
+	return time.Unix(0, int64(epoch*float64(unit))), nil
+}
+
+// Pick the point time for a message, preferring the timestamp embedded in the
+// payload (--timestamps) and falling back to the time it was received
+func (p *Plumber) pointTime(messageTopic string, data map[string]interface{}, received time.Time) time.Time {
+	rule := p.timestampRules.Match(messageTopic)
+	if rule == nil {
+		return received
+	}
+
+	field := rule.Value.(*TimestampField)
+	value, ok := data[field.Name]
+	if !ok {
+		return received
+	}
+
+	t, err := field.Time(value)
+	if err != nil {
+		if p.config.Verbose {
+			status("", WARN, fmt.Sprintf("Bad timestamp in %s field %q: %s\n", messageTopic, field.Name, err))
+		}
+		return received
+	}
+
+	return t
+}
@@ -0,0 +1,119 @@
+package plumber
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	HIDDEN      = '$'
+	WILD_SINGLE = '+' // U+002B
+	WILD_MULTI  = '#' // U+0023
+
+	TOKEN_SEP    = "(?:/|$)"
+	TOKEN_SINGLE = "([\\d\\w\\s-_]+(?:/|$))"
+	TOKEN_MULTI  = "((?:[\\d\\w\\s-_]+/?)*)$"
+
+	// Matching follows the MQTT spec, the tokens above are what the
+	// persisted `params` have always been
+	MATCH_SINGLE = "([^/]+)"
+	MATCH_MULTI  = "(.*)"
+)
+
+type Parser struct {
+	topic       string
+	hidden, sys bool
+	tokens      []string
+	params      []Param
+	re          *regexp.Regexp // matcher
+	paramsRe    *regexp.Regexp
+}
+
+type Param struct {
+	i, index int
+	wild     rune
+	re       string
+}
+
+func NewParser(topic string) *Parser {
+	return &Parser{topic: topic}
+}
+
+func (p *Parser) Match(topic string) bool {
+	// Wildcards at the first level never match hidden ($SYS etc) topics
+	if len(topic) > 0 && topic[0] == HIDDEN && !p.hidden {
+		return false
+	}
+	return p.re.MatchString(topic)
+}
+
+// Params of a topic as persisted, the match followed by the wildcard levels
+func (p *Parser) Params(topic string) []string {
+	return p.paramsRe.FindStringSubmatch(topic)
+}
+
+// Wildcards of a matching topic, the topic followed by the value of each
+// wildcard (without separators)
+func (p *Parser) Wildcards(topic string) []string {
+	return p.re.FindStringSubmatch(topic)
+}
+
+func (p *Parser) Parse() {
+	subtopic := []rune(p.topic)
+	index := 0
+
+	p.tokens = strings.Split(p.topic, "/")
+	matchTokens := make([]string, len(p.tokens))
+	p.hidden = p.topic[0] == HIDDEN
+	p.sys = p.tokens[0] == "$SYS"
+
+	for i, token := range p.tokens {
+		idx := strings.Index(string(subtopic), token)
+		subtopic = subtopic[idx:]
+		index += idx
+
+		param := Param{i: i, index: index}
+
+		switch token {
+		case "+":
+			param.wild = WILD_SINGLE
+			param.re = TOKEN_SINGLE
+			matchTokens[i] = MATCH_SINGLE
+		case "#":
+			param.wild = WILD_MULTI
+			param.re = TOKEN_MULTI
+			matchTokens[i] = MATCH_MULTI
+		default:
+			matchTokens[i] = regexp.QuoteMeta(token)
+			continue
+		}
+
+		p.params = append(p.params, param)
+		p.tokens[i] = param.re
+	}
+
+	p.paramsRe = regexp.MustCompile(strings.Join(p.tokens, "/"))
+
+	pattern := strings.Join(matchTokens, "/")
+	if n := len(matchTokens); n > 1 && matchTokens[n-1] == MATCH_MULTI {
+		// `a/#` also matches the parent level `a`
+		pattern = strings.Join(matchTokens[:n-1], "/") + "(?:/" + MATCH_MULTI + ")?"
+	}
+
+	p.re = regexp.MustCompile("^" + pattern + "$")
+}
+
+func Parse(topic string) *Parser {
+	parser := NewParser(topic)
+	parser.Parse()
+	return parser
+}
+
+// Split a shared subscription `$share/<group>/<filter>` into its group and
+// filter. The group is empty for ordinary filters.
+func sharedFilter(topic string) (group string, filter string) {
+	if parts := strings.SplitN(topic, "/", 3); len(parts) == 3 && parts[0] == "$share" {
+		return parts[1], parts[2]
+	}
+	return "", topic
+}
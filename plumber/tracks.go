@@ -0,0 +1,420 @@
+package plumber
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+//
+// Tracks
+//
+
+// Default time gap that splits a track into segments
+const DefaultTrackGap = 10 * time.Minute
+
+// Default time range of tracks, when only the end is given
+const defaultTrackRange = 24 * time.Hour
+
+// Track formats and their content types
+var trackFormats = map[string]string{
+	"geojson": "application/geo+json",
+	"gpx":     "application/gpx+xml",
+}
+
+// StoredPoint is a point read back from a sink
+type StoredPoint struct {
+	Time time.Time
+	Data map[string]interface{}
+}
+
+// PointReader is a Sink that can read points back, oldest first and at most
+// limit of them
+type PointReader interface {
+	Read(series string, from, to time.Time, limit int) ([]*StoredPoint, error)
+}
+
+// TrackPoint is a location on a track
+type TrackPoint struct {
+	Time   time.Time
+	Lat    float64
+	Lon    float64
+	Alt    float64
+	HasAlt bool
+}
+
+// Track is the path of a device, split into segments at gaps
+type Track struct {
+	Device   string
+	Segments [][]TrackPoint
+}
+
+// TrackOptions for rebuilding tracks
+type TrackOptions struct {
+	Device    string        // only this device (default is every device)
+	Tolerance float64       // Douglas-Peucker tolerance in meters (0 keeps every point)
+	Gap       time.Duration // split at time gaps longer than this (0 never does)
+	Jump      float64       // split at jumps further than this many meters (0 never does)
+}
+
+// TrackLimitError is returned for time ranges with more points than the
+// query limit
+type TrackLimitError struct {
+	Limit int
+}
+
+func (e *TrackLimitError) Error() string {
+	return fmt.Sprintf("more than %d points in the time range, narrow it", e.Limit)
+}
+
+// Tracks rebuilds the paths of devices from the locations persisted to a
+// series between from and to. The range can't be over the max query range,
+// or hold more points than the query limit (0 disables track reads, like
+// queries).
+func (p *Plumber) Tracks(series string, from, to time.Time, options TrackOptions) ([]*Track, error) {
+	limit := p.config.QueryLimit
+	if limit <= 0 {
+		return nil, errQueriesDisabled
+	}
+	if err := p.checkTrackRange(from, to); err != nil {
+		return nil, err
+	}
+	reader, ok := p.sink.(PointReader)
+	if !ok {
+		return nil, fmt.Errorf("the sink can't read points back")
+	}
+
+	points, err := reader.Read(series, from, to, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(points) > limit {
+		return nil, &TrackLimitError{limit}
+	}
+	return BuildTracks(points, options), nil
+}
+
+// TrackRange parses the bounds of a track time range (see ParseTrackTime),
+// the end defaults to now and the start to a day before it, or the max query
+// range if shorter
+func (p *Plumber) TrackRange(from, to string, now time.Time) (start, end time.Time, err error) {
+	if end, err = ParseTrackTime(to, now, now); err != nil {
+		return
+	}
+	def := defaultTrackRange
+	if maxRange := p.trackMaxRange(); maxRange < def {
+		def = maxRange
+	}
+	if start, err = ParseTrackTime(from, now, end.Add(-def)); err != nil {
+		return
+	}
+	err = p.checkTrackRange(start, end)
+	return
+}
+
+// The start has to be before the end, within the max query range
+func (p *Plumber) checkTrackRange(from, to time.Time) error {
+	if !from.Before(to) {
+		return fmt.Errorf("the start %s is not before the end %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+	if maxRange := p.trackMaxRange(); to.Sub(from) > maxRange {
+		return fmt.Errorf("time range %s is over the max of %s", to.Sub(from), maxRange)
+	}
+	return nil
+}
+
+func (p *Plumber) trackMaxRange() time.Duration {
+	if p.config.QueryMaxRange <= 0 {
+		return DefaultQueryMaxRange
+	}
+	return p.config.QueryMaxRange
+}
+
+// BuildTracks groups located points by device, splits them at gaps and
+// simplifies the segments. Devices are sorted, segments with a single
+// point are dropped.
+func BuildTracks(points []*StoredPoint, options TrackOptions) []*Track {
+	byDevice := make(map[string][]TrackPoint)
+	for _, point := range points {
+		lat, lon, ok := location(point.Data)
+		if !ok {
+			continue
+		}
+		topic, _ := point.Data["topic"].(string)
+		device := locationDevice(topic, point.Data)
+		if len(options.Device) > 0 && device != options.Device {
+			continue
+		}
+
+		trackPoint := TrackPoint{Time: point.Time, Lat: lat, Lon: lon}
+		for _, name := range []string{"alt", "altitude"} {
+			if alt, ok := point.Data[name].(float64); ok {
+				trackPoint.Alt, trackPoint.HasAlt = alt, true
+				break
+			}
+		}
+		byDevice[device] = append(byDevice[device], trackPoint)
+	}
+
+	var devices []string
+	for device := range byDevice {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+
+	tracks := []*Track{}
+	for _, device := range devices {
+		track := &Track{Device: device}
+		for _, segment := range splitTrack(byDevice[device], options.Gap, options.Jump) {
+			if len(segment) > 1 {
+				track.Segments = append(track.Segments, simplifyTrack(segment, options.Tolerance))
+			}
+		}
+		if len(track.Segments) > 0 {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks
+}
+
+type byTrackTime []TrackPoint
+
+func (s byTrackTime) Len() int           { return len(s) }
+func (s byTrackTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTrackTime) Less(i, j int) bool { return s[i].Time.Before(s[j].Time) }
+
+// Split points into segments wherever the time between two is over gap or
+// the distance over jump. Repeated points (same time and place) are dropped.
+func splitTrack(points []TrackPoint, gap time.Duration, jump float64) [][]TrackPoint {
+	sort.Stable(byTrackTime(points))
+
+	var segments [][]TrackPoint
+	var segment []TrackPoint
+	for _, point := range points {
+		if n := len(segment); n > 0 {
+			last := segment[n-1]
+			if point.Time.Equal(last.Time) && point.Lat == last.Lat && point.Lon == last.Lon {
+				continue
+			}
+			if (gap > 0 && point.Time.Sub(last.Time) > gap) || (jump > 0 && distance(last.Lat, last.Lon, point.Lat, point.Lon) > jump) {
+				segments = append(segments, segment)
+				segment = nil
+			}
+		}
+		segment = append(segment, point)
+	}
+	if len(segment) > 0 {
+		segments = append(segments, segment)
+	}
+	return segments
+}
+
+// Douglas-Peucker simplification, keeping the points that are further than
+// tolerance meters from the line through the points kept around them
+func simplifyTrack(points []TrackPoint, tolerance float64) []TrackPoint {
+	if tolerance <= 0 || len(points) < 3 {
+		return points
+	}
+
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+
+	// Spans left to check, instead of recursing (tracks can be long)
+	spans := [][2]int{{0, len(points) - 1}}
+	for len(spans) > 0 {
+		first, last := spans[len(spans)-1][0], spans[len(spans)-1][1]
+		spans = spans[:len(spans)-1]
+
+		farthest, max := 0, 0.0
+		for i := first + 1; i < last; i++ {
+			if d := segmentDistance(points[i], points[first], points[last]); d > max {
+				farthest, max = i, d
+			}
+		}
+		if max > tolerance {
+			keep[farthest] = true
+			spans = append(spans, [2]int{first, farthest}, [2]int{farthest, last})
+		}
+	}
+
+	var simplified []TrackPoint
+	for i, point := range points {
+		if keep[i] {
+			simplified = append(simplified, point)
+		}
+	}
+	return simplified
+}
+
+// Distance in meters from p to the line segment a-b, on a plane tangent at
+// a (fine at the distances between track points)
+func segmentDistance(p, a, b TrackPoint) float64 {
+	rad := math.Pi / 180
+	scale := math.Cos(a.Lat * rad)
+	project := func(q TrackPoint) (float64, float64) {
+		dLon := q.Lon - a.Lon
+		if dLon > 180 {
+			dLon -= 360
+		} else if dLon < -180 {
+			dLon += 360
+		}
+		return dLon * rad * scale * earthRadius, (q.Lat - a.Lat) * rad * earthRadius
+	}
+
+	px, py := project(p)
+	bx, by := project(b)
+	length := bx*bx + by*by
+	if length == 0 {
+		return math.Hypot(px, py)
+	}
+	t := math.Max(0, math.Min(1, (px*bx+py*by)/length))
+	return math.Hypot(px-t*bx, py-t*by)
+}
+
+// Content type of a track format, and whether it's known
+func TrackContentType(format string) (string, bool) {
+	contentType, ok := trackFormats[format]
+	return contentType, ok
+}
+
+// Write tracks as `geojson` or `gpx`
+func WriteTracks(w io.Writer, tracks []*Track, format string) error {
+	switch format {
+	case "geojson":
+		return writeGeoJSON(w, tracks)
+	case "gpx":
+		return writeGPX(w, tracks)
+	}
+	return fmt.Errorf("unknown track format %q (want geojson or gpx)", format)
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONLineString      `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONLineString struct {
+	Type        string      `json:"type"`
+	Coordinates [][]float64 `json:"coordinates"`
+}
+
+// A FeatureCollection with a LineString feature per segment. Properties are
+// the device, segment number, start and end, and the time of every
+// coordinate in `coordTimes` (like GPX converters do).
+func writeGeoJSON(w io.Writer, tracks []*Track) error {
+	features := []geoJSONFeature{}
+	for _, track := range tracks {
+		for i, segment := range track.Segments {
+			// Altitudes only if every point has one, coordinates can't mix
+			withAlt := true
+			for _, point := range segment {
+				withAlt = withAlt && point.HasAlt
+			}
+
+			line := geoJSONLineString{Type: "LineString"}
+			var times []string
+			for _, point := range segment {
+				coordinate := []float64{point.Lon, point.Lat}
+				if withAlt {
+					coordinate = append(coordinate, point.Alt)
+				}
+				line.Coordinates = append(line.Coordinates, coordinate)
+				times = append(times, point.Time.UTC().Format(time.RFC3339Nano))
+			}
+
+			features = append(features, geoJSONFeature{
+				Type:     "Feature",
+				Geometry: line,
+				Properties: map[string]interface{}{
+					"device":     track.Device,
+					"segment":    i,
+					"start":      times[0],
+					"end":        times[len(times)-1],
+					"coordTimes": times,
+				},
+			})
+		}
+	}
+
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":     "FeatureCollection",
+		"features": features,
+	})
+}
+
+type gpxFile struct {
+	XMLName xml.Name   `xml:"gpx"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Version string     `xml:"version,attr"`
+	Creator string     `xml:"creator,attr"`
+	Tracks  []gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name     string       `xml:"name"`
+	Segments []gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxPoint struct {
+	Lat  float64  `xml:"lat,attr"`
+	Lon  float64  `xml:"lon,attr"`
+	Ele  *float64 `xml:"ele,omitempty"`
+	Time string   `xml:"time"`
+}
+
+// A GPX 1.1 document with a trk per device and a trkseg per segment
+func writeGPX(w io.Writer, tracks []*Track) error {
+	gpx := gpxFile{Xmlns: "http://www.topografix.com/GPX/1/1", Version: "1.1", Creator: "mqtt-plumber"}
+	for _, track := range tracks {
+		trk := gpxTrack{Name: track.Device}
+		for _, segment := range track.Segments {
+			var trkseg gpxSegment
+			for _, point := range segment {
+				trkpt := gpxPoint{Lat: point.Lat, Lon: point.Lon, Time: point.Time.UTC().Format(time.RFC3339Nano)}
+				if point.HasAlt {
+					alt := point.Alt
+					trkpt.Ele = &alt
+				}
+				trkseg.Points = append(trkseg.Points, trkpt)
+			}
+			trk.Segments = append(trk.Segments, trkseg)
+		}
+		gpx.Tracks = append(gpx.Tracks, trk)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(gpx); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// Parse a track time range bound, RFC3339 or a duration before now (e.g.
+// `24h`), empty is def
+func ParseTrackTime(s string, now time.Time, def time.Time) (time.Time, error) {
+	if len(s) == 0 {
+		return def, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q (want RFC3339 or a duration ago)", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,76 @@
+package plumber
+
+import (
+	"testing"
+	"time"
+)
+
+// Sink reading back a point a minute from a fixed start
+type testTrackSink struct {
+	testSink
+	points int
+	limit  int // of the last read
+}
+
+func (s *testTrackSink) Read(series string, from, to time.Time, limit int) ([]*StoredPoint, error) {
+	s.limit = limit
+	var points []*StoredPoint
+	for i := 0; i < s.points && i < limit; i++ {
+		points = append(points, &StoredPoint{
+			Time: from.Add(time.Duration(i) * time.Minute),
+			Data: map[string]interface{}{"lat": 52.0 + float64(i)/1000, "lon": 4.0, "topic": "owntracks/user1/phone"},
+		})
+	}
+	return points, nil
+}
+
+func TestTracksLimits(t *testing.T) {
+	sink := &testTrackSink{points: 5}
+	p, err := New(Config{Broker: "tcp://fake:1883", QueryMaxRange: time.Hour, QueryLimit: 5, Logger: DiscardLogger}, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	from, to, err := p.TrackRange("", "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !to.Equal(now) || !from.Equal(now.Add(-time.Hour)) {
+		t.Errorf("default range = %v - %v, want the max range before now", from, to)
+	}
+
+	tracks, err := p.Tracks("owntracks/#", from, to, TrackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 1 || len(tracks[0].Segments[0]) != 5 {
+		t.Errorf("tracks = %v", tracks)
+	}
+	if sink.limit != 6 {
+		t.Errorf("read limit = %d, want one over the query limit", sink.limit)
+	}
+
+	// Too many points are refused rather than cut short
+	sink.points = 6
+	if _, err := p.Tracks("owntracks/#", from, to, TrackOptions{}); err == nil {
+		t.Error("read more points than the limit")
+	} else if _, ok := err.(*TrackLimitError); !ok {
+		t.Errorf("err = %v, want a TrackLimitError", err)
+	}
+
+	for _, bounds := range [][2]string{{"2h", ""}, {"2026-10-01T12:00:00Z", "2026-10-01T11:00:00Z"}, {"10m", "10m"}} {
+		if from, to, err := p.TrackRange(bounds[0], bounds[1], now); err == nil {
+			t.Errorf("range %v accepted as %v - %v", bounds, from, to)
+		}
+	}
+	if _, err := p.Tracks("owntracks/#", to, from, TrackOptions{}); err == nil {
+		t.Error("Tracks accepted the start after the end")
+	}
+
+	// A limit of 0 disables track reads, like queries
+	p.config.QueryLimit = 0
+	if _, err := p.Tracks("owntracks/#", from, to, TrackOptions{}); err != errQueriesDisabled {
+		t.Errorf("err = %v without a limit, want queries disabled", err)
+	}
+}
@@ -0,0 +1,411 @@
+package plumber
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook delivery defaults
+const (
+	webhookTimeout    = 10 * time.Second
+	webhookRetries    = 3
+	webhookBackoff    = time.Second
+	webhookMaxBackoff = time.Minute
+	webhookFlush      = 5 * time.Second
+	webhookWorkers    = 4
+	webhookQueue      = 1000
+
+	// Header carrying the hex HMAC-SHA256 of the body, when signing
+	webhookSignatureHeader = "X-Plumber-Signature"
+)
+
+// Webhook is an HTTP endpoint messages on a topic filter are POSTed to
+type Webhook struct {
+	URL     string // template, {topic}, {broker} and {1}, {2}... for topic params
+	Headers http.Header
+	Secret  string // HMAC signing key
+	Batch   int    // messages per NDJSON request, 1 is a json request per message
+	Timeout time.Duration
+	Retries int
+}
+
+// Parse a `url;option;option` webhook rule value, where options are
+// `header:Name=value`, `hmac:secret`, `batch:n`, `timeout:duration` and
+// `retries:n`, e.g. "https://svc/devices/{1};batch:50;hmac:s3cret"
+func parseWebhook(value string) (interface{}, error) {
+	options := strings.Split(value, ";")
+	hook := &Webhook{
+		URL:     strings.TrimSpace(options[0]),
+		Headers: make(http.Header),
+		Batch:   1,
+		Timeout: webhookTimeout,
+		Retries: webhookRetries,
+	}
+
+	if _, err := url.Parse(hook.URL); err != nil || len(hook.URL) == 0 {
+		return nil, fmt.Errorf("invalid webhook url %q", hook.URL)
+	}
+
+	for _, option := range options[1:] {
+		parts := strings.SplitN(strings.TrimSpace(option), ":", 2)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid webhook option %q", option)
+		}
+
+		var err error
+		switch arg := parts[1]; parts[0] {
+		case "header":
+			header := strings.SplitN(arg, "=", 2)
+			if len(header) < 2 {
+				return nil, fmt.Errorf("invalid webhook header %q", arg)
+			}
+			hook.Headers.Add(header[0], header[1])
+		case "hmac":
+			hook.Secret = arg
+		case "batch":
+			if hook.Batch, err = strconv.Atoi(arg); err != nil || hook.Batch < 1 {
+				return nil, fmt.Errorf("invalid webhook batch size %q", arg)
+			}
+		case "timeout":
+			if hook.Timeout, err = time.ParseDuration(arg); err != nil {
+				return nil, fmt.Errorf("invalid webhook timeout %q", arg)
+			}
+		case "retries":
+			if hook.Retries, err = strconv.Atoi(arg); err != nil || hook.Retries < 0 {
+				return nil, fmt.Errorf("invalid webhook retries %q", arg)
+			}
+		default:
+			return nil, fmt.Errorf("unknown webhook option %q", parts[0])
+		}
+	}
+
+	return hook, nil
+}
+
+// Expand the URL template for a message topic, given the topic params.
+// Topic levels are escaped one by one, so they stay path segments.
+func (h *Webhook) url(broker string, topic string, params []string) string {
+	levels := strings.Split(topic, "/")
+	for i := range levels {
+		levels[i] = url.PathEscape(levels[i])
+	}
+	expanded := strings.Replace(h.URL, "{topic}", strings.Join(levels, "/"), -1)
+	expanded = strings.Replace(expanded, "{broker}", url.PathEscape(broker), -1)
+	for i := len(params) - 1; i > 0; i-- {
+		expanded = strings.Replace(expanded, "{"+strconv.Itoa(i)+"}", url.PathEscape(params[i]), -1)
+	}
+	return expanded
+}
+
+// A request ready to be sent, as kept in the spool
+type webhookDelivery struct {
+	URL         string        `json:"url"`
+	ContentType string        `json:"content_type"`
+	Headers     http.Header   `json:"headers"`
+	Body        []byte        `json:"body"`
+	Timeout     time.Duration `json:"timeout"`
+	Retries     int           `json:"-"`
+}
+
+// A batch of NDJSON lines waiting for a webhook url
+type webhookBatch struct {
+	hook  *Webhook
+	lines [][]byte
+}
+
+// Webhooks POSTs messages to the webhooks of matching rules, retrying with
+// backoff and spooling deliveries that still fail to disk
+type Webhooks struct {
+	sync.Mutex
+	rules   Rules
+	spool   string                   // directory, empty disables spooling
+	queue   chan *webhookDelivery    // nil unless running
+	batches map[string]*webhookBatch // by expanded url
+	verbose bool
+
+	stop    chan struct{}
+	running sync.WaitGroup
+}
+
+func NewWebhooks(rules Rules, spool string, verbose bool) *Webhooks {
+	return &Webhooks{
+		rules:   rules,
+		spool:   spool,
+		verbose: verbose,
+		batches: make(map[string]*webhookBatch),
+	}
+}
+
+// Send a normalized message to every matching webhook
+func (w *Webhooks) Send(messageTopic string, data map[string]interface{}, received time.Time) {
+	message := make(map[string]interface{}, len(data)+1)
+	for key, value := range data {
+		message[key] = value
+	}
+	message["received"] = received.Format(time.RFC3339Nano)
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		status("HOOK", ERR, fmt.Sprintln("Failed to encode message", messageTopic, err))
+		return
+	}
+
+	broker, _ := data["broker"].(string)
+	for _, rule := range w.rules {
+		if !rule.Match(messageTopic) {
+			continue
+		}
+
+		hook := rule.Value.(*Webhook)
+		target := hook.url(broker, messageTopic, rule.parser.Wildcards(messageTopic))
+		if hook.Batch == 1 {
+			w.enqueue(hook.delivery(target, "application/json", body))
+			continue
+		}
+
+		w.Lock()
+		batch, ok := w.batches[target]
+		if !ok {
+			batch = &webhookBatch{hook: hook}
+			w.batches[target] = batch
+		}
+		batch.lines = append(batch.lines, body)
+		full := len(batch.lines) >= hook.Batch
+		if full {
+			delete(w.batches, target)
+		}
+		w.Unlock()
+
+		if full {
+			w.enqueue(hook.delivery(target, "application/x-ndjson", ndjson(batch.lines)))
+		}
+	}
+}
+
+func ndjson(lines [][]byte) []byte {
+	return append(bytes.Join(lines, []byte("\n")), '\n')
+}
+
+func (h *Webhook) delivery(target string, contentType string, body []byte) *webhookDelivery {
+	headers := make(http.Header)
+	for name, values := range h.Headers {
+		headers[name] = values
+	}
+
+	if len(h.Secret) > 0 {
+		mac := hmac.New(sha256.New, []byte(h.Secret))
+		mac.Write(body)
+		headers.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	return &webhookDelivery{
+		URL:         target,
+		ContentType: contentType,
+		Headers:     headers,
+		Body:        body,
+		Timeout:     h.Timeout,
+		Retries:     h.Retries,
+	}
+}
+
+// Queue a delivery, spooling it right away when the workers can't keep up
+// (or aren't running)
+func (w *Webhooks) enqueue(d *webhookDelivery) {
+	w.Lock()
+	queued := false
+	if w.queue != nil {
+		select {
+		case w.queue <- d:
+			queued = true
+		default:
+		}
+	}
+	w.Unlock()
+
+	if !queued {
+		w.spoolDelivery(d)
+	}
+}
+
+// Send all partial batches
+func (w *Webhooks) Flush() {
+	w.Lock()
+	batches := w.batches
+	w.batches = make(map[string]*webhookBatch)
+	w.Unlock()
+
+	for target, batch := range batches {
+		w.enqueue(batch.hook.delivery(target, "application/x-ndjson", ndjson(batch.lines)))
+	}
+}
+
+// Start the delivery workers, batch flushing and spool redelivery in the
+// background until Stop
+func (w *Webhooks) Run() {
+	queue := make(chan *webhookDelivery, webhookQueue)
+	w.Lock()
+	w.queue = queue
+	w.Unlock()
+	w.stop = make(chan struct{})
+
+	w.running.Add(webhookWorkers)
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			defer w.running.Done()
+			for d := range queue {
+				if err := w.deliver(d); err != nil {
+					status("HOOK", ERR, fmt.Sprintln("Failed to deliver to", d.URL, err))
+					w.spoolDelivery(d)
+				}
+			}
+		}()
+	}
+
+	// Call f every interval until Stop, and right away if first
+	every := func(interval time.Duration, first bool, f func()) {
+		w.running.Add(1)
+		go func(stop chan struct{}) {
+			defer w.running.Done()
+			if first {
+				f()
+			}
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					f()
+				case <-stop:
+					return
+				}
+			}
+		}(w.stop)
+	}
+
+	every(webhookFlush, false, w.Flush)
+	if len(w.spool) > 0 {
+		every(webhookMaxBackoff, true, w.resend)
+	}
+}
+
+// Stop sends the partial batches and waits for the queued deliveries, which
+// are spooled if they still fail
+func (w *Webhooks) Stop() {
+	if w.stop == nil {
+		return
+	}
+	close(w.stop)
+	w.stop = nil
+	w.Flush()
+
+	w.Lock()
+	close(w.queue)
+	w.queue = nil
+	w.Unlock()
+	w.running.Wait()
+}
+
+// Deliver with retries, backing off exponentially between attempts
+func (w *Webhooks) deliver(d *webhookDelivery) error {
+	backoff := webhookBackoff
+	var err error
+	for attempt := 0; attempt <= d.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > webhookMaxBackoff {
+				backoff = webhookMaxBackoff
+			}
+		}
+
+		if err = d.post(); err == nil {
+			if w.verbose {
+				status("HOOK", OK, fmt.Sprintln("Delivered to", d.URL))
+			}
+			return nil
+		}
+	}
+	return err
+}
+
+func (d *webhookDelivery) post() error {
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	for name, values := range d.Headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", d.ContentType)
+
+	client := &http.Client{Timeout: d.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}
+
+// Write a failed delivery to the spool directory
+func (w *Webhooks) spoolDelivery(d *webhookDelivery) {
+	if len(w.spool) == 0 {
+		status("HOOK", ERR, fmt.Sprintln("Dropping delivery to", d.URL, "(no --webhook-spool)"))
+		return
+	}
+
+	data, err := json.Marshal(d)
+	if err == nil {
+		name := fmt.Sprintf("%d-%08x.json", time.Now().UnixNano(), rand.Uint32())
+		err = ioutil.WriteFile(filepath.Join(w.spool, name), data, 0600)
+	}
+	if err != nil {
+		status("HOOK", ERR, fmt.Sprintln("Failed to spool delivery to", d.URL, err))
+	}
+}
+
+// Try each spooled delivery once more, removing those that succeed
+func (w *Webhooks) resend() {
+	files, err := filepath.Glob(filepath.Join(w.spool, "*.json"))
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		d := &webhookDelivery{}
+		if err := json.Unmarshal(data, d); err != nil {
+			status("HOOK", ERR, fmt.Sprintln("Skipping bad spool file", file, err))
+			continue
+		}
+
+		if err := d.post(); err != nil {
+			// Still down, don't hammer it with the rest of the spool
+			return
+		}
+
+		os.Remove(file)
+		status("HOOK", OK, fmt.Sprintln("Delivered spooled message to", d.URL))
+	}
+}